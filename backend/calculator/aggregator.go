@@ -0,0 +1,161 @@
+package calculator
+
+import (
+	"container/ring"
+	"path"
+	"sort"
+)
+
+// Aggregator computes a custom statistic over the intervals of a series.
+// Observe never runs concurrently with another call on the same aggregator,
+// so implementations need no locking of their own. Snapshot, and reading
+// an aggregator passed to Merge, may happen concurrently with each other and
+// must not modify its state. Aggregator state is not included in snapshots
+// and starts empty after a restart.
+type Aggregator interface {
+	// Observe adds an interval in milliseconds
+	Observe(intervalMs float64)
+	// Snapshot returns the current value of the statistic
+	Snapshot() float64
+	// Merge folds the state of another aggregator of the same type into this
+	// one; comparison series use it to combine the variants of a target
+	Merge(other Aggregator)
+}
+
+// AggregatorConfig attaches an aggregator to a family of series. Patterns
+// use path.Match syntax; an empty pattern matches everything.
+type AggregatorConfig struct {
+	Name          string // Key of the result in MetricsUpdate.aggregates
+	TargetPattern string
+	KeyPattern    string
+	New           func() Aggregator
+}
+
+func (cfg *AggregatorConfig) matches(targetID, key string) bool {
+	return matchPattern(cfg.TargetPattern, targetID) && matchPattern(cfg.KeyPattern, key)
+}
+
+// matchPattern reports whether value matches a path.Match pattern. An empty
+// or malformed pattern only matches if it is empty.
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// newAggregators creates the aggregators configured for a series
+func (c *MetricsCalculator) newAggregators(targetID, key string) map[string]Aggregator {
+	var aggregators map[string]Aggregator
+	for i := range c.config.Aggregators {
+		cfg := &c.config.Aggregators[i]
+		if cfg.New == nil || !cfg.matches(targetID, key) {
+			continue
+		}
+		if aggregators == nil {
+			aggregators = make(map[string]Aggregator)
+		}
+		aggregators[cfg.Name] = cfg.New()
+	}
+	return aggregators
+}
+
+// mergeAggregators folds the aggregators of the series into the ones of the
+// same name in merged
+func (m *Metrics) mergeAggregators(merged map[string]Aggregator) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for name, a := range m.aggregators {
+		if into, ok := merged[name]; ok {
+			into.Merge(a)
+		}
+	}
+}
+
+// CountOverBudget counts the intervals that exceeded a budget
+type CountOverBudget struct {
+	BudgetMs float64
+	count    int64
+}
+
+// NewCountOverBudget returns a factory for AggregatorConfig.New
+func NewCountOverBudget(budgetMs float64) func() Aggregator {
+	return func() Aggregator {
+		return &CountOverBudget{BudgetMs: budgetMs}
+	}
+}
+
+func (a *CountOverBudget) Observe(intervalMs float64) {
+	if intervalMs > a.BudgetMs {
+		a.count++
+	}
+}
+
+func (a *CountOverBudget) Snapshot() float64 {
+	return float64(a.count)
+}
+
+func (a *CountOverBudget) Merge(other Aggregator) {
+	if o, ok := other.(*CountOverBudget); ok {
+		a.count += o.count
+	}
+}
+
+// TrimmedMean is the mean of the most recent MaxSamples intervals after
+// dropping the given fraction from each end
+type TrimmedMean struct {
+	Trim    float64 // Fraction dropped from each end, e.g. 0.05
+	samples *ring.Ring
+}
+
+// NewTrimmedMean returns a factory for AggregatorConfig.New
+func NewTrimmedMean(trim float64) func() Aggregator {
+	return func() Aggregator {
+		return &TrimmedMean{Trim: trim, samples: ring.New(MaxSamples)}
+	}
+}
+
+func (a *TrimmedMean) Observe(intervalMs float64) {
+	a.samples = a.samples.Next()
+	a.samples.Value = intervalMs
+}
+
+func (a *TrimmedMean) Snapshot() float64 {
+	values := a.values()
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+
+	drop := int(float64(len(values)) * a.Trim)
+	if 2*drop >= len(values) {
+		drop = (len(values) - 1) / 2
+	}
+	values = values[drop : len(values)-drop]
+
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func (a *TrimmedMean) Merge(other Aggregator) {
+	if o, ok := other.(*TrimmedMean); ok {
+		for _, v := range o.values() {
+			a.Observe(v)
+		}
+	}
+}
+
+// values returns the retained samples, oldest first
+func (a *TrimmedMean) values() []float64 {
+	var values []float64
+	a.samples.Next().Do(func(v any) {
+		if v != nil {
+			values = append(values, v.(float64))
+		}
+	})
+	return values
+}
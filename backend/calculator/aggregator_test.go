@@ -0,0 +1,84 @@
+package calculator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountOverBudget(t *testing.T) {
+	a := NewCountOverBudget(100)()
+	for _, v := range []float64{50, 100, 150, 300} {
+		a.Observe(v)
+	}
+	assert.Equal(t, 2.0, a.Snapshot())
+
+	other := NewCountOverBudget(100)()
+	other.Observe(200)
+	a.Merge(other)
+	assert.Equal(t, 3.0, a.Snapshot())
+
+	// Merging a different aggregator type is ignored
+	a.Merge(NewTrimmedMean(0.1)())
+	assert.Equal(t, 3.0, a.Snapshot())
+}
+
+func TestTrimmedMean(t *testing.T) {
+	a := NewTrimmedMean(0.1)()
+	assert.Equal(t, 0.0, a.Snapshot())
+
+	// One outlier on each end is trimmed away
+	for _, v := range []float64{1000, 10, 10, 10, 10, 20, 20, 20, 20, 0} {
+		a.Observe(v)
+	}
+	assert.Equal(t, 15.0, a.Snapshot())
+
+	other := NewTrimmedMean(0.1)()
+	for range 10 {
+		other.Observe(15)
+	}
+	a.Merge(other)
+	assert.InDelta(t, 15.0, a.Snapshot(), 0.001)
+
+	// Trimming never discards every sample
+	single := NewTrimmedMean(0.5)()
+	single.Observe(42)
+	assert.Equal(t, 42.0, single.Snapshot())
+}
+
+func TestAggregatorsInUpdates(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{
+		Aggregators: []AggregatorConfig{
+			{Name: "over_150ms", TargetPattern: "prod-*", New: NewCountOverBudget(150)},
+			{Name: "trimmed_mean", KeyPattern: "api-*", New: NewTrimmedMean(0.1)},
+		},
+	})
+	sub := calc.Subscribe()
+	stop := runCalculator(t, calc)
+	defer stop()
+
+	base := time.Now()
+	for _, offset := range []int{0, 100, 300, 400, 700} {
+		event := createTestEvent("prod-east", "db-query", nil)
+		event.ServerTimestamp = base.Add(time.Duration(offset) * time.Millisecond).UnixNano()
+		require.NoError(t, calc.ProcessEvent(event))
+	}
+	time.Sleep(shortWait)
+
+	var last map[string]float64
+	for len(sub) > 0 {
+		last = (<-sub).Aggregates
+	}
+	require.NotNil(t, last)
+	assert.Equal(t, 2.0, last["over_150ms"], "The 200ms and 300ms gaps exceed the budget")
+	assert.NotContains(t, last, "trimmed_mean", "Key pattern does not match")
+}
+
+func TestMatchPattern(t *testing.T) {
+	assert.True(t, matchPattern("", "anything"))
+	assert.True(t, matchPattern("prod-*", "prod-us-east"))
+	assert.False(t, matchPattern("prod-*", "staging-us-east"))
+	assert.False(t, matchPattern("[", "["), "Malformed patterns never match")
+}
@@ -0,0 +1,162 @@
+package calculator
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+var (
+	ErrBaselineNotFound = errors.New("baseline not found")
+	ErrBaselineExists   = errors.New("baseline already exists")
+	ErrInvalidBaseline  = errors.New("baseline needs a name and a target")
+	ErrTargetNotFound   = errors.New("target has no series")
+)
+
+// baseline is a captured baseline indexed by series ID
+type baseline struct {
+	*proto.Baseline
+	series map[string]*proto.BaselineSeries
+}
+
+func newBaseline(b *proto.Baseline) *baseline {
+	series := make(map[string]*proto.BaselineSeries, len(b.Series))
+	for _, s := range b.Series {
+		series[s.SeriesId] = s
+	}
+	return &baseline{Baseline: b, series: series}
+}
+
+// CaptureBaseline records the current stats of every series of a target
+// under name. The baseline is checkpointed right away when snapshots are
+// enabled.
+func (c *MetricsCalculator) CaptureBaseline(name, targetID string) (*proto.Baseline, error) {
+	if name == "" || targetID == "" {
+		return nil, ErrInvalidBaseline
+	}
+
+	b := &proto.Baseline{
+		Name:      name,
+		TargetId:  targetID,
+		CreatedAt: time.Now().UnixNano(),
+	}
+	c.metricsMu.RLock()
+	for _, m := range c.metrics {
+		if m.TargetID != targetID || !m.hasIntervals() {
+			continue
+		}
+		b.Series = append(b.Series, &proto.BaselineSeries{
+			SeriesId: m.id,
+			Key:      m.Key,
+			Metadata: m.Metadata,
+			Count:    m.Count(),
+			Min:      m.Min(),
+			Max:      m.Max(),
+			Avg:      m.Avg(),
+			P90:      m.P90(),
+		})
+	}
+	c.metricsMu.RUnlock()
+	if len(b.Series) == 0 {
+		return nil, ErrTargetNotFound
+	}
+	sort.Slice(b.Series, func(i, j int) bool { return b.Series[i].SeriesId < b.Series[j].SeriesId })
+
+	c.baselinesMu.Lock()
+	if _, exists := c.baselines[name]; exists {
+		c.baselinesMu.Unlock()
+		return nil, ErrBaselineExists
+	}
+	c.baselines[name] = newBaseline(b)
+	c.baselinesMu.Unlock()
+
+	if err := c.saveSnapshot(); err != nil {
+		log.Printf("Failed to save snapshot: %v", err)
+	}
+	return b, nil
+}
+
+// Baselines returns all baselines, sorted by name
+func (c *MetricsCalculator) Baselines() []*proto.Baseline {
+	c.baselinesMu.RLock()
+	defer c.baselinesMu.RUnlock()
+
+	baselines := make([]*proto.Baseline, 0, len(c.baselines))
+	for _, b := range c.baselines {
+		baselines = append(baselines, b.Baseline)
+	}
+	sort.Slice(baselines, func(i, j int) bool { return baselines[i].Name < baselines[j].Name })
+	return baselines
+}
+
+// Baseline returns the baseline captured under name
+func (c *MetricsCalculator) Baseline(name string) (*proto.Baseline, error) {
+	c.baselinesMu.RLock()
+	defer c.baselinesMu.RUnlock()
+
+	b, exists := c.baselines[name]
+	if !exists {
+		return nil, ErrBaselineNotFound
+	}
+	return b.Baseline, nil
+}
+
+// DeleteBaseline removes the baseline captured under name
+func (c *MetricsCalculator) DeleteBaseline(name string) error {
+	c.baselinesMu.Lock()
+	if _, exists := c.baselines[name]; !exists {
+		c.baselinesMu.Unlock()
+		return ErrBaselineNotFound
+	}
+	delete(c.baselines, name)
+	c.baselinesMu.Unlock()
+
+	if err := c.saveSnapshot(); err != nil {
+		log.Printf("Failed to save snapshot: %v", err)
+	}
+	return nil
+}
+
+// addBaselineDeltas compares an update against every baseline holding its
+// series, ordered by baseline name
+func (c *MetricsCalculator) addBaselineDeltas(update *proto.MetricsUpdate) {
+	c.baselinesMu.RLock()
+	defer c.baselinesMu.RUnlock()
+
+	for _, b := range c.baselines {
+		ref, exists := b.series[update.SeriesId]
+		if !exists {
+			continue
+		}
+
+		delta := &proto.SeriesDelta{
+			ReferenceTargetId: b.TargetId,
+			TargetId:          update.TargetId,
+			AvgDelta:          update.Avg - ref.Avg,
+			P90Delta:          update.P90 - ref.P90,
+			Baseline:          b.Name,
+		}
+		if ref.Avg != 0 {
+			delta.AvgRatio = delta.AvgDelta / ref.Avg
+		}
+		if ref.P90 != 0 {
+			delta.P90Ratio = delta.P90Delta / ref.P90
+		}
+		update.BaselineDeltas = append(update.BaselineDeltas, delta)
+	}
+	sort.Slice(update.BaselineDeltas, func(i, j int) bool {
+		return update.BaselineDeltas[i].Baseline < update.BaselineDeltas[j].Baseline
+	})
+}
+
+// restoreBaselines loads persisted baselines
+func (c *MetricsCalculator) restoreBaselines(baselines []*proto.Baseline) {
+	c.baselinesMu.Lock()
+	defer c.baselinesMu.Unlock()
+	for _, b := range baselines {
+		c.baselines[b.Name] = newBaseline(b)
+	}
+}
@@ -0,0 +1,115 @@
+package calculator
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendAt sends events of the test key at the given offsets from base
+func sendAt(t *testing.T, calc *MetricsCalculator, targetID string, base time.Time, offsets ...time.Duration) {
+	t.Helper()
+	for _, offset := range offsets {
+		event := createTestEvent(targetID, testKey, nil)
+		event.ServerTimestamp = base.Add(offset).UnixNano()
+		require.NoError(t, calc.ProcessEvent(event))
+	}
+}
+
+func TestCaptureBaseline(t *testing.T) {
+	calc := NewMetricsCalculator()
+	stop := runCalculator(t, calc)
+	defer stop()
+
+	_, err := calc.CaptureBaseline("", testTargetID)
+	assert.ErrorIs(t, err, ErrInvalidBaseline)
+	_, err = calc.CaptureBaseline("before", testTargetID)
+	assert.ErrorIs(t, err, ErrTargetNotFound, "A target without intervals has nothing to capture")
+
+	base := time.Now()
+	sendAt(t, calc, testTargetID, base, 0, 100*time.Millisecond, 200*time.Millisecond)
+	sendAt(t, calc, "other-target", base, 0, 500*time.Millisecond)
+	time.Sleep(shortWait)
+
+	baseline, err := calc.CaptureBaseline("before", testTargetID)
+	require.NoError(t, err)
+	require.Len(t, baseline.Series, 1, "Only the target's series are captured")
+	assert.Equal(t, testKey, baseline.Series[0].Key)
+	assert.InDelta(t, 100.0, baseline.Series[0].P90, 1e-6)
+
+	_, err = calc.CaptureBaseline("before", testTargetID)
+	assert.ErrorIs(t, err, ErrBaselineExists)
+
+	got, err := calc.Baseline("before")
+	require.NoError(t, err)
+	assert.Equal(t, baseline, got)
+	assert.Len(t, calc.Baselines(), 1)
+
+	require.NoError(t, calc.DeleteBaseline("before"))
+	assert.ErrorIs(t, calc.DeleteBaseline("before"), ErrBaselineNotFound)
+	_, err = calc.Baseline("before")
+	assert.ErrorIs(t, err, ErrBaselineNotFound)
+}
+
+func TestBaselineDeltas(t *testing.T) {
+	calc := NewMetricsCalculator()
+	stop := runCalculator(t, calc)
+	defer stop()
+	ch := calc.Subscribe()
+
+	base := time.Now()
+	sendAt(t, calc, testTargetID, base, 0, 100*time.Millisecond, 200*time.Millisecond)
+	time.Sleep(shortWait)
+	_, err := calc.CaptureBaseline("b", testTargetID)
+	require.NoError(t, err)
+	_, err = calc.CaptureBaseline("a", testTargetID)
+	require.NoError(t, err)
+	for len(ch) > 0 {
+		<-ch
+	}
+
+	// A 400ms interval lifts the average from 100ms to 200ms
+	sendAt(t, calc, testTargetID, base, 600*time.Millisecond)
+
+	select {
+	case update := <-ch:
+		require.Len(t, update.BaselineDeltas, 2)
+		assert.Equal(t, "a", update.BaselineDeltas[0].Baseline)
+		assert.Equal(t, "b", update.BaselineDeltas[1].Baseline)
+		assert.InDelta(t, 100.0, update.BaselineDeltas[0].AvgDelta, 1e-6)
+		assert.InDelta(t, 1.0, update.BaselineDeltas[0].AvgRatio, 1e-6)
+		assert.Equal(t, testTargetID, update.BaselineDeltas[0].ReferenceTargetId)
+	case <-time.After(time.Second):
+		t.Fatal("No update received")
+	}
+}
+
+func TestBaselinesPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.snapshot")
+
+	calc := NewMetricsCalculatorWithConfig(Config{SnapshotPath: path})
+	stop := runCalculator(t, calc)
+	sendAt(t, calc, testTargetID, time.Now(), 0, 100*time.Millisecond)
+	time.Sleep(shortWait)
+	baseline, err := calc.CaptureBaseline("before", testTargetID)
+	require.NoError(t, err)
+	stop()
+
+	restored := NewMetricsCalculatorWithConfig(Config{SnapshotPath: path})
+	stop = runCalculator(t, restored)
+	defer stop()
+
+	got, err := restored.Baseline("before")
+	require.NoError(t, err)
+	assert.Equal(t, baseline.CreatedAt, got.CreatedAt)
+	require.Len(t, got.Series, 1)
+	assert.Equal(t, baseline.Series[0].Avg, got.Series[0].Avg)
+
+	updates := restored.GetAllMetrics()
+	require.Len(t, updates, 1)
+	require.Len(t, updates[0].BaselineDeltas, 1)
+	assert.Equal(t, 0.0, updates[0].BaselineDeltas[0].AvgDelta)
+}
@@ -3,8 +3,11 @@ package calculator
 import (
 	"container/ring"
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,20 +26,55 @@ const (
 	P90Percentile = 90
 )
 
+var (
+	ErrSeriesNotFound = errors.New("series not found")
+	ErrQueueFull      = errors.New("event queue full")
+	ErrStopping       = errors.New("calculator is stopping")
+	ErrInvalidEvent   = errors.New("invalid event")
+)
+
 type Metrics struct {
 	TargetID string
 	Key      string
 	Metadata map[string]string
 
-	Samples *ring.Ring // Circular buffer of recent samples
+	Samples *ring.Ring // Circular buffer of recent intervals in milliseconds
 	mu      sync.RWMutex
 
+	id          string                // Series key in the calculator
+	history     *seriesHistory        // Downsampled history, guarded by mu
+	aggregators map[string]Aggregator // Custom statistics by name, guarded by mu
+	heatmap     *seriesHeatmap        // Latency-over-time columns, guarded by mu
+	schedule    *seriesSchedule       // Declared-schedule tracking, guarded by mu
+
+	maxExemplar      *proto.Exemplar   // Event behind the current max, guarded by mu
+	outlierExemplars []*proto.Exemplar // Recent events above the P90, guarded by mu
+
 	// All fields below are accessed atomically
 	count int64 // Number of samples
 	min   int64 // Minimum latency in milliseconds (stored as int64 to use atomic operations)
 	max   int64 // Maximum latency in milliseconds (stored as int64 to use atomic operations)
 	avg   int64 // Average latency in milliseconds (stored as int64 to use atomic operations)
 	p90   int64 // 90th percentile latency in milliseconds (stored as int64 to use atomic operations)
+
+	jitter       int64 // RFC 3550 interarrival jitter in nanoseconds
+	lastInterval int64 // Previous interval in nanoseconds, guarded by mu
+
+	// Interval bookkeeping, guarded by mu
+	previousTimeMs float64 // Timestamp of the latest event in milliseconds
+	hasPrevious    bool    // Whether the next event closes an interval
+	intervals      int64   // Number of intervals observed
+	clockEpoch     int64   // Clock epoch of the target when last updated
+
+	// Sample-rate weighted totals, guarded by mu
+	estimatedCount float64 // Events extrapolated from each event's sample rate
+	firstWeight    float64 // Weight of the first event, which closes no interval
+	firstTimestamp int64
+	lastTimestamp  int64
+
+	// Exponentially decaying count of recently received events, guarded by mu
+	recentCount float64
+	recentTime  int64 // Receive time of the latest event in Unix nanoseconds
 }
 
 // Count returns the current count of samples (thread-safe)
@@ -64,93 +102,381 @@ func (m *Metrics) P90() float64 {
 	return float64(atomic.LoadInt64(&m.p90)) / float64(time.Millisecond)
 }
 
+// Jitter returns the RFC 3550 interarrival jitter in milliseconds (thread-safe)
+func (m *Metrics) Jitter() float64 {
+	return float64(atomic.LoadInt64(&m.jitter)) / float64(time.Millisecond)
+}
+
+// EstimatedCount returns the number of events extrapolated from the sample
+// rates of the received ones (thread-safe)
+func (m *Metrics) EstimatedCount() float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.estimatedCount
+}
+
+// Throughput returns the extrapolated event rate in events per second
+// (thread-safe)
+func (m *Metrics) Throughput() float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.throughput()
+}
+
+func (m *Metrics) throughput() float64 {
+	span := time.Duration(m.lastTimestamp - m.firstTimestamp).Seconds()
+	if span <= 0 {
+		return 0
+	}
+	// N events span N-1 intervals, so the first event doesn't count
+	return (m.estimatedCount - m.firstWeight) / span
+}
+
+// sampleWeight returns how many events a received event stands for. Events
+// without a valid sample rate stand for themselves.
+func sampleWeight(event *proto.Event) float64 {
+	if event.SampleRate <= 0 || event.SampleRate > 1 {
+		return 1
+	}
+	return 1 / event.SampleRate
+}
+
+// ID returns the stable identifier of the series
+func (m *Metrics) ID() string {
+	return m.id
+}
+
+// Config holds the optional settings of a MetricsCalculator.
+type Config struct {
+	// SnapshotPath is the file series state is checkpointed to and restored
+	// from at startup. Snapshots are disabled when empty.
+	SnapshotPath string
+	// SnapshotInterval is how often state is checkpointed while running.
+	// Defaults to DefaultSnapshotInterval.
+	SnapshotInterval time.Duration
+	// HistoryResolutions are the downsampled history levels kept per series.
+	// Defaults to DefaultHistoryResolutions.
+	HistoryResolutions []HistoryResolution
+	// HistorySnapshotStep is the finest history resolution checkpointed to
+	// the history journal next to the snapshot; finer levels start empty
+	// after a restart. Defaults to DefaultHistorySnapshotStep.
+	HistorySnapshotStep time.Duration
+	// Comparisons declares derived series comparing keys across targets
+	Comparisons []ComparisonConfig
+	// Aggregators adds custom statistics to the series they match
+	Aggregators []AggregatorConfig
+	// HeatmapColumn is the time width of a heatmap column. Defaults to
+	// DefaultHeatmapColumn.
+	HeatmapColumn time.Duration
+	// HeatmapBuckets are the latency bucket upper bounds in milliseconds,
+	// sorted ascending. Defaults to DefaultHeatmapBuckets.
+	HeatmapBuckets []float64
+	// HeatmapRetention is how much heatmap history is kept per series.
+	// Defaults to DefaultHeatmapRetention.
+	HeatmapRetention time.Duration
+	// Schedules declares the expected period of scheduled series
+	Schedules []ScheduleConfig
+	// DedupWindow is how long event IDs are remembered to drop resent
+	// events. Deduplication is disabled when zero.
+	DedupWindow time.Duration
+	// DedupCapacity bounds the number of remembered event IDs. Defaults to
+	// DefaultDedupCapacity.
+	DedupCapacity int
+	// ClockStepThreshold is how far a target's clock offset may jump from
+	// its estimate before it counts as a clock step. Intervals spanning a
+	// step are discarded. Events received together count as one delivery,
+	// so batching producers are fine, but the threshold must exceed the
+	// variation in how late producers deliver their freshest event. Step
+	// detection is disabled when zero.
+	ClockStepThreshold time.Duration
+	// Pipelines declares the final stage of stage-tagged series, which
+	// completes a job and closes its end-to-end latency. Jobs of other
+	// series end at the last stage seen before they time out.
+	Pipelines []PipelineConfig
+	// PipelineTimeout is how long a job may take from its first stage before
+	// it is forgotten, or ended if no final stage is declared for it.
+	// Defaults to DefaultPipelineTimeout.
+	PipelineTimeout time.Duration
+	// PipelineCapacity bounds the number of jobs in flight. Defaults to
+	// DefaultPipelineCapacity.
+	PipelineCapacity int
+	// PausePolicy decides what happens to events sent while paused
+	PausePolicy PausePolicy
+	// ClockCorrection subtracts each target's estimated clock offset from
+	// its event timestamps before computing intervals
+	ClockCorrection bool
+	// CaptureDir is the directory StartCapture records events to. Capture
+	// is disabled when empty.
+	CaptureDir string
+	// CaptureFileSize is the size at which a capture file is rotated.
+	// Defaults to DefaultCaptureFileSize.
+	CaptureFileSize int64
+	// CaptureFiles is how many files of a capture are kept, deleting the
+	// oldest. Defaults to DefaultCaptureFiles.
+	CaptureFiles int
+}
+
 type MetricsCalculator struct {
-	metrics   map[string]*Metrics // key: targetID:key:metadataHash
-	metricsMu sync.RWMutex
+	config Config
+
+	metrics    map[string]*Metrics   // key: targetID:key:metadataHash
+	byKey      map[string][]*Metrics // key: targetID:key, all metadata variants
+	discovery  discoveryIndex        // Series counts by target, key and metadata
+	metricsMu  sync.RWMutex
+	snapshotMu sync.Mutex
 
-	updateCh      chan *proto.Event
+	historyJournal historyJournal // guarded by snapshotMu
+
+	updateCh      chan queuedEvent
 	subscribers   map[chan *proto.MetricsUpdate]struct{}
 	subscribersMu sync.RWMutex
 
-	doOnce sync.Once
-	stopCh chan struct{}
+	heatmapSubscribers map[chan *proto.HeatmapFrame]struct{} // guarded by subscribersMu
+
+	topKViews map[topKKey]*topKView // guarded by topKMu
+	topKMu    sync.Mutex
+
+	baselines   map[string]*baseline // By name
+	baselinesMu sync.RWMutex
+
+	targets   map[string]*targetState
+	targetsMu sync.RWMutex
+	dedup     *dedupCache      // nil when disabled; only used by the Start goroutine
+	pipelines *pipelineTracker // Only used by the Start goroutine
+
+	capture     *captureRecorder // nil when not capturing, guarded by captureMu
+	lastCapture *captureRecorder // The running or latest capture, guarded by captureMu
+	captureMu   sync.RWMutex
+
+	state   atomic.Int32 // A State; changed under stateMu
+	stateMu sync.Mutex
+	stopCh  chan struct{} // Closed to stop the current run, guarded by stateMu
+	done    chan struct{} // Closed when the current run ends, guarded by stateMu
+	wakeCh  chan struct{} // Signals the Start loop to re-check the state
+	started bool          // Whether Start ran before, guarded by stateMu
 }
 
 func NewMetricsCalculator() *MetricsCalculator {
+	return NewMetricsCalculatorWithConfig(Config{})
+}
+
+// NewMetricsCalculatorWithConfig creates a calculator with the given settings.
+func NewMetricsCalculatorWithConfig(config Config) *MetricsCalculator {
+	if config.SnapshotInterval <= 0 {
+		config.SnapshotInterval = DefaultSnapshotInterval
+	}
+	if len(config.HistoryResolutions) == 0 {
+		config.HistoryResolutions = DefaultHistoryResolutions
+	}
+	if config.HistorySnapshotStep <= 0 {
+		config.HistorySnapshotStep = DefaultHistorySnapshotStep
+	}
+	if config.HeatmapColumn <= 0 {
+		config.HeatmapColumn = DefaultHeatmapColumn
+	}
+	if len(config.HeatmapBuckets) == 0 {
+		config.HeatmapBuckets = DefaultHeatmapBuckets
+	}
+	if config.HeatmapRetention <= 0 {
+		config.HeatmapRetention = DefaultHeatmapRetention
+	}
+	if config.DedupCapacity <= 0 {
+		config.DedupCapacity = DefaultDedupCapacity
+	}
+	if config.PipelineTimeout <= 0 {
+		config.PipelineTimeout = DefaultPipelineTimeout
+	}
+	if config.PipelineCapacity <= 0 {
+		config.PipelineCapacity = DefaultPipelineCapacity
+	}
+	if config.CaptureFileSize <= 0 {
+		config.CaptureFileSize = DefaultCaptureFileSize
+	}
+	if config.CaptureFiles <= 0 {
+		config.CaptureFiles = DefaultCaptureFiles
+	}
+
+	var dedup *dedupCache
+	if config.DedupWindow > 0 {
+		dedup = newDedupCache(config.DedupWindow, config.DedupCapacity)
+	}
 	return &MetricsCalculator{
+		config:      config,
 		metrics:     make(map[string]*Metrics),
-		updateCh:    make(chan *proto.Event, 1000),
+		byKey:       make(map[string][]*Metrics),
+		discovery:   make(discoveryIndex),
+		updateCh:    make(chan queuedEvent, 1000),
 		subscribers: make(map[chan *proto.MetricsUpdate]struct{}),
-		stopCh:      make(chan struct{}),
+		wakeCh:      make(chan struct{}, 1),
+
+		heatmapSubscribers: make(map[chan *proto.HeatmapFrame]struct{}),
+		targets:            make(map[string]*targetState),
+		dedup:              dedup,
+		topKViews:          make(map[topKKey]*topKView),
+		baselines:          make(map[string]*baseline),
+		pipelines:          newPipelineTracker(config.PipelineTimeout, config.PipelineCapacity),
+		historyJournal:     historyJournal{rewrite: true},
 	}
 }
 
-// Start starts the metrics calculator, blocking until the calculator is stopped.
+// Start runs the metrics calculator, blocking until it is stopped or ctx is
+// done. A stopped calculator can be started again and picks up where it left
+// off; the snapshot is only restored on the first start.
 func (c *MetricsCalculator) Start(ctx context.Context) error {
 	select {
-	case <-c.stopCh:
-		return nil
 	case <-ctx.Done():
 		return ctx.Err()
 	default:
 	}
 
+	stopCh, done, first, err := c.begin()
+	if err != nil {
+		return err
+	}
+
 	fmt.Println("Starting metrics calculator...")
-	defer func() {
-		// Clean up resources when exiting
-		c.subscribersMu.Lock()
-		for ch := range c.subscribers {
-			close(ch)
+	if first {
+		if err := c.restoreSnapshot(); err != nil {
+			log.Printf("Failed to restore snapshot: %v", err)
 		}
-		c.subscribers = make(map[chan *proto.MetricsUpdate]struct{})
-		c.subscribersMu.Unlock()
+	}
+
+	// A nil channel never fires, so periodic checkpoints are off without a path
+	var snapshotTick <-chan time.Time
+	if c.config.SnapshotPath != "" {
+		ticker := time.NewTicker(c.config.SnapshotInterval)
+		defer ticker.Stop()
+		snapshotTick = ticker.C
+	}
 
-		// Clear metrics
-		c.metricsMu.Lock()
-		c.metrics = make(map[string]*Metrics)
-		c.metricsMu.Unlock()
+	defer func() {
+		// Checkpoint so a stop is as durable as a shutdown
+		if err := c.saveSnapshot(); err != nil {
+			log.Printf("Failed to save snapshot: %v", err)
+		}
+		c.end(done)
 	}()
 
 	for {
+		// Leave events queued while paused
+		updates := c.updateCh
+		if c.State() == StatePaused {
+			updates = nil
+		}
+
 		select {
-		case <-c.stopCh:
+		case <-stopCh:
 			return nil
 		case <-ctx.Done():
 			return ctx.Err()
-		case event, ok := <-c.updateCh:
-			if !ok {
-				return nil
+		case <-c.wakeCh:
+			// The state changed; re-evaluate it
+		case <-snapshotTick:
+			if err := c.saveSnapshot(); err != nil {
+				log.Printf("Failed to save snapshot: %v", err)
 			}
-			metrics := c.getOrCreateMetrics(event)
-			metrics.Update(event)
-
-			// Create and send update to subscribers
-			update := &proto.MetricsUpdate{
-				TargetId:    event.TargetId,
-				Key:         event.Key,
-				Min:         metrics.Min(),
-				Max:         metrics.Max(),
-				Avg:         metrics.Avg(),
-				P90:         metrics.P90(),
-				Count:       metrics.Count(),
-				LastUpdated: time.Now().UnixNano(),
-				Metadata:    event.Metadata,
-			}
-
-			c.notifySubscribers(update)
+		case queued := <-updates:
+			c.handleEvent(queued.event, queued.receivedAt)
 		}
 	}
 }
 
+// queuedEvent is an event waiting for the Start goroutine
+type queuedEvent struct {
+	event      *proto.Event
+	receivedAt time.Time
+}
+
+// handleEvent folds a single event into its series and notifies subscribers
+func (c *MetricsCalculator) handleEvent(event *proto.Event, receivedAt time.Time) {
+	if c.isDuplicate(event) {
+		return
+	}
+
+	event, epoch := c.trackClock(event, receivedAt)
+	metrics := c.getOrCreateMetrics(event)
+	metrics.syncClockEpoch(epoch)
+	metrics.recordArrival(receivedAt, sampleWeight(event))
+	if event.DurationNs != nil {
+		metrics.ObserveLatency(event, float64(event.GetDurationNs())/float64(time.Millisecond))
+	} else {
+		metrics.Update(event)
+	}
+	c.publish(metrics, event)
+
+	for _, stage := range c.trackPipeline(event, receivedAt) {
+		metrics := c.getOrCreateMetrics(stage.event)
+		metrics.recordArrival(receivedAt, sampleWeight(stage.event))
+		metrics.ObserveLatency(stage.event, stage.latencyMs)
+		c.publish(metrics, stage.event)
+	}
+}
+
+// publish sends the state of a series just updated by event to subscribers
+func (c *MetricsCalculator) publish(metrics *Metrics, event *proto.Event) {
+	update := metrics.toUpdate()
+	c.addBaselineDeltas(update)
+	c.notifySubscribers(update)
+	c.updateTopK(metrics)
+	for _, update := range c.comparisonUpdates(event.TargetId, event.Key) {
+		c.notifySubscribers(update)
+	}
+	for _, frame := range metrics.drainHeatmapFrames() {
+		c.notifyHeatmapSubscribers(frame)
+	}
+}
+
+// ProcessEvent queues an event for the calculator. Events queued while the
+// calculator is stopped or paused are processed once it runs again, unless
+// Config.PausePolicy drops them while paused. Every event is recorded by a
+// running capture, including those turned away.
 func (c *MetricsCalculator) ProcessEvent(event *proto.Event) error {
+	receivedAt := time.Now()
+	c.captureEvent(event, receivedAt)
+
+	switch c.State() {
+	case StateClosed:
+		return ErrStopping
+	case StatePaused:
+		if c.config.PausePolicy == PauseDrop {
+			return ErrPaused
+		}
+	}
+
 	select {
-	case c.updateCh <- event:
+	case c.updateCh <- queuedEvent{event: event, receivedAt: receivedAt}:
 		return nil
-	case <-c.stopCh:
-		return fmt.Errorf("calculator is stopping")
 	default:
-		return fmt.Errorf("event queue full")
+		return ErrQueueFull
+	}
+}
+
+// QueueUsage returns the fraction of the event queue in use, from 0 when
+// empty to 1 when ProcessEvent would return ErrQueueFull
+func (c *MetricsCalculator) QueueUsage() float64 {
+	return float64(len(c.updateCh)) / float64(cap(c.updateCh))
+}
+
+// ValidateEvent checks the fields an event needs before it can be processed.
+// Errors wrap ErrInvalidEvent.
+func ValidateEvent(event *proto.Event) error {
+	switch {
+	case event.TargetId == "":
+		return fmt.Errorf("%w: missing target ID", ErrInvalidEvent)
+	case event.Key == "":
+		return fmt.Errorf("%w: missing key", ErrInvalidEvent)
+	case event.ServerTimestamp <= 0:
+		return fmt.Errorf("%w: missing server timestamp", ErrInvalidEvent)
+	case event.SampleRate < 0 || event.SampleRate > 1:
+		return fmt.Errorf("%w: sample rate %v outside [0, 1]", ErrInvalidEvent, event.SampleRate)
+	case event.PayloadSize < 0:
+		return fmt.Errorf("%w: negative payload size", ErrInvalidEvent)
+	case event.GetDurationNs() < 0:
+		return fmt.Errorf("%w: negative duration", ErrInvalidEvent)
+	case event.Stage != "" && event.JobId == "":
+		return fmt.Errorf("%w: stage %q without a job ID", ErrInvalidEvent, event.Stage)
 	}
+	return nil
 }
 
 func (c *MetricsCalculator) Subscribe() chan *proto.MetricsUpdate {
@@ -175,46 +501,33 @@ func (c *MetricsCalculator) GetAllMetrics() []*proto.MetricsUpdate {
 
 	updates := make([]*proto.MetricsUpdate, 0, len(c.metrics))
 	for _, m := range c.metrics {
-		// Only include metrics that have at least 2 events (so we have intervals)
-		if m.Count() >= 2 {
-			update := &proto.MetricsUpdate{
-				TargetId:    m.TargetID,
-				Key:         m.Key,
-				Min:         m.Min(),
-				Max:         m.Max(),
-				Avg:         m.Avg(),
-				P90:         m.P90(),
-				Count:       m.Count(),
-				LastUpdated: time.Now().UnixNano(),
-				Metadata:    m.Metadata,
-			}
+		// Only include metrics that have observed intervals
+		if m.hasIntervals() {
+			update := m.toUpdate()
+			c.addBaselineDeltas(update)
 			updates = append(updates, update)
 		}
 	}
-	return updates
+	return append(updates, c.allComparisonsLocked()...)
 }
 
-// Stop shuts down the metrics calculator and cleans up all resources.
-// It's safe to call Stop multiple times.
+// Stop stops processing events and waits for Start to return. State and
+// subscribers are kept, so the calculator can be started again; use Close to
+// tear it down for good. It's safe to call Stop multiple times.
 func (c *MetricsCalculator) Stop() {
-	c.doOnce.Do(func() {
-		// Close the stop channel to signal the Start goroutine to exit
-		close(c.stopCh)
-
-		// Close the update channel to prevent new events from being processed
-		c.metricsMu.Lock()
-		defer c.metricsMu.Unlock()
-		close(c.updateCh)
-		c.metrics = nil
-
-		// Close all subscriber channels
-		c.subscribersMu.Lock()
-		defer c.subscribersMu.Unlock()
-		for ch := range c.subscribers {
-			close(ch)
-		}
-		c.subscribers = nil
-	})
+	c.stateMu.Lock()
+	state, stopCh, done := c.State(), c.stopCh, c.done
+	// The state only changes once Start returns, so a concurrent Stop may
+	// find the channel already closed
+	if (state == StateRunning || state == StatePaused) && stopCh != nil {
+		close(stopCh)
+		c.stopCh = nil
+	}
+	c.stateMu.Unlock()
+
+	if done != nil {
+		<-done
+	}
 }
 
 func (c *MetricsCalculator) metric(key string) (*Metrics, bool) {
@@ -226,27 +539,51 @@ func (c *MetricsCalculator) metric(key string) (*Metrics, bool) {
 
 func (c *MetricsCalculator) createMetric(key string, event *proto.Event) *Metrics {
 	metrics := &Metrics{
-		TargetID: event.TargetId,
-		Key:      event.Key,
-		Metadata: event.Metadata,
-		Samples:  ring.New(MaxSamples),
+		TargetID:    event.TargetId,
+		Key:         event.Key,
+		Metadata:    event.Metadata,
+		Samples:     ring.New(MaxSamples),
+		id:          key,
+		history:     newSeriesHistory(c.config.HistoryResolutions),
+		aggregators: c.newAggregators(event.TargetId, event.Key),
+		heatmap:     c.newSeriesHeatmap(),
+		schedule:    c.newSchedule(event.TargetId, event.Key),
 	}
 
 	c.metricsMu.Lock()
 	defer c.metricsMu.Unlock()
-	c.metrics[key] = metrics
+	c.addMetricLocked(metrics)
 	return metrics
 }
 
-func (c *MetricsCalculator) getOrCreateMetrics(event *proto.Event) *Metrics {
-	// Create a unique key for this target + key + metadata combination
-	key := event.TargetId + ":" + event.Key
-	if len(event.Metadata) > 0 {
-		// Simple hash of metadata for key uniqueness
-		for k, v := range event.Metadata {
-			key += ":" + k + "=" + v
-		}
+// addMetricLocked registers a series; callers hold metricsMu
+func (c *MetricsCalculator) addMetricLocked(m *Metrics) {
+	c.metrics[m.id] = m
+	targetKey := m.TargetID + ":" + m.Key
+	c.byKey[targetKey] = append(c.byKey[targetKey], m)
+	c.discovery.add(m)
+}
+
+// seriesKey builds the unique key of a target + key + metadata combination.
+// Metadata is appended in sorted order so the key is stable across events
+// and restarts.
+func seriesKey(targetID, key string, metadata map[string]string) string {
+	names := make([]string, 0, len(metadata))
+	for k := range metadata {
+		names = append(names, k)
 	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(targetID + ":" + key)
+	for _, k := range names {
+		b.WriteString(":" + k + "=" + metadata[k])
+	}
+	return b.String()
+}
+
+func (c *MetricsCalculator) getOrCreateMetrics(event *proto.Event) *Metrics {
+	key := seriesKey(event.TargetId, event.Key, event.Metadata)
 
 	metrics, exists := c.metric(key)
 	if !exists {
@@ -269,48 +606,148 @@ func (c *MetricsCalculator) notifySubscribers(update *proto.MetricsUpdate) {
 	}
 }
 
+// toUpdate builds the MetricsUpdate sent to subscribers for the series
+func (m *Metrics) toUpdate() *proto.MetricsUpdate {
+	update := &proto.MetricsUpdate{
+		TargetId:    m.TargetID,
+		Key:         m.Key,
+		Min:         m.Min(),
+		Max:         m.Max(),
+		Avg:         m.Avg(),
+		P90:         m.P90(),
+		Count:       m.Count(),
+		LastUpdated: time.Now().UnixNano(),
+		Metadata:    m.Metadata,
+		SeriesId:    m.id,
+		Jitter:      m.Jitter(),
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	update.EstimatedCount = m.estimatedCount
+	update.Throughput = m.throughput()
+	if len(m.aggregators) > 0 {
+		update.Aggregates = make(map[string]float64, len(m.aggregators))
+		for name, a := range m.aggregators {
+			update.Aggregates[name] = a.Snapshot()
+		}
+	}
+	if m.schedule != nil {
+		update.Schedule = m.schedule.stats()
+	}
+	update.MaxExemplar = m.maxExemplar
+	update.OutlierExemplars = append([]*proto.Exemplar(nil), m.outlierExemplars...)
+	return update
+}
+
 func (m *Metrics) Update(event *proto.Event) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	count := atomic.LoadInt64(&m.count)
+	count := atomic.AddInt64(&m.count, 1)
 	currentTimeMs := float64(event.ServerTimestamp) / float64(time.Millisecond)
 
-	// Store the current timestamp in milliseconds in the circular buffer
-	m.Samples = m.Samples.Next()
-	m.Samples.Value = currentTimeMs
+	weight := sampleWeight(event)
+	m.estimatedCount += weight
+	if count == 1 {
+		m.firstWeight = weight
+		m.firstTimestamp = event.ServerTimestamp
+	}
+	if event.ServerTimestamp > m.lastTimestamp {
+		m.lastTimestamp = event.ServerTimestamp
+	}
 
-	// Increment count first
-	atomic.AddInt64(&m.count, 1)
+	// Remember this event's timestamp for the next interval
+	previousTimeMs, hasPrevious := m.previousTimeMs, m.hasPrevious
+	m.previousTimeMs, m.hasPrevious = currentTimeMs, true
+	if m.schedule != nil {
+		m.schedule.record(currentTimeMs)
+	}
 
-	// For the first event, we just store the timestamp and return
-	// We need at least 2 events to calculate an interval
-	if count == 0 {
+	// For the first event (or the first after a reset), we just store the
+	// timestamp and return. We need 2 events to calculate an interval
+	if !hasPrevious {
 		return
 	}
 
 	// Calculate time since last event for this key
-	var intervalMs float64
-	if m.Samples.Prev() != nil && m.Samples.Prev().Value != nil {
-		// Get the last timestamp from the ring buffer (stored in milliseconds)
-		lastEventTimeMs := m.Samples.Prev().Value.(float64)
-		intervalMs = currentTimeMs - lastEventTimeMs
-		// Ensure interval is non-negative
-		if intervalMs < 0 {
-			intervalMs = 0
+	intervalMs := currentTimeMs - previousTimeMs
+	// Ensure interval is non-negative
+	if intervalMs < 0 {
+		intervalMs = 0
+	}
+	m.observe(event, intervalMs)
+}
+
+// ObserveLatency records a latency measured by the producer rather than
+// derived from arrival times, such as the duration of a pipeline stage
+func (m *Metrics) ObserveLatency(event *proto.Event, latencyMs float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := atomic.AddInt64(&m.count, 1)
+	weight := sampleWeight(event)
+	m.estimatedCount += weight
+	if count == 1 {
+		// As with intervals, N events span N-1 gaps for the throughput
+		m.firstWeight = weight
+		m.firstTimestamp = event.ServerTimestamp
+	}
+	if event.ServerTimestamp > m.lastTimestamp {
+		m.lastTimestamp = event.ServerTimestamp
+	}
+	if m.schedule != nil {
+		m.schedule.record(float64(event.ServerTimestamp) / float64(time.Millisecond))
+	}
+	if latencyMs < 0 {
+		latencyMs = 0
+	}
+	m.observe(event, latencyMs)
+}
+
+// hasIntervals reports whether the series has observed any interval yet
+func (m *Metrics) hasIntervals() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.intervals > 0
+}
+
+// syncClockEpoch discards the open interval if the target's clock stepped
+// since the series was last updated, so the jump never counts as latency.
+// A declared schedule takes its phase from the next tick.
+func (m *Metrics) syncClockEpoch(epoch int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.clockEpoch != epoch {
+		m.clockEpoch = epoch
+		m.hasPrevious = false
+		if m.schedule != nil {
+			m.schedule.reanchor()
 		}
 	}
+}
+
+// observe folds an interval closed by event into the statistics; callers
+// hold mu
+func (m *Metrics) observe(event *proto.Event, intervalMs float64) {
+	// Store the interval in milliseconds in the circular buffer
+	m.Samples = m.Samples.Next()
+	m.Samples.Value = intervalMs
 
 	// Convert interval to nanoseconds for atomic operations (storing as int64)
 	intervalNs := int64(intervalMs * float64(millisecondsToNanoseconds))
+	intervals := m.intervals
+	m.intervals++
 
-	// For the second event (count was 1, now 2), initialize min/max/avg
-	if count == 1 {
+	// For the first interval, initialize min/max/avg
+	if intervals == 0 {
 		atomic.StoreInt64(&m.min, intervalNs)
 		atomic.StoreInt64(&m.max, intervalNs)
 		atomic.StoreInt64(&m.avg, intervalNs)
+		m.lastInterval = intervalNs
 		p90 := m.calculatePercentile(P90Percentile)
 		atomic.StoreInt64(&m.p90, int64(p90*float64(time.Millisecond)))
+		m.recordInterval(event, intervalMs)
 		return
 	}
 
@@ -336,12 +773,21 @@ func (m *Metrics) Update(event *proto.Event) {
 		}
 	}
 
-	// Update average (count is now the new count after increment)
+	// Update jitter from the change between consecutive intervals, smoothed
+	// with the 1/16 gain of RFC 3550 section 6.4.1
+	d := intervalNs - m.lastInterval
+	if d < 0 {
+		d = -d
+	}
+	jitter := atomic.LoadInt64(&m.jitter)
+	atomic.StoreInt64(&m.jitter, jitter+(d-jitter)/16)
+	m.lastInterval = intervalNs
+
+	// Update average
 	for {
 		currentAvg := atomic.LoadInt64(&m.avg)
-		// We have count intervals now (since we incremented count already)
-		// The average should be: (old_avg * (count-1) + new_interval) / count
-		newAvg := (currentAvg*(count-1) + intervalNs) / count
+		// The average should be: (old_avg * old_intervals + new_interval) / intervals
+		newAvg := (currentAvg*intervals + intervalNs) / (intervals + 1)
 		if atomic.CompareAndSwapInt64(&m.avg, currentAvg, newAvg) {
 			break
 		}
@@ -349,41 +795,43 @@ func (m *Metrics) Update(event *proto.Event) {
 
 	p90 := m.calculatePercentile(P90Percentile)
 	atomic.StoreInt64(&m.p90, int64(p90*float64(time.Millisecond)))
+	m.recordInterval(event, intervalMs)
 }
 
-func (m *Metrics) calculatePercentile(p float64) float64 {
-	count := atomic.LoadInt64(&m.count)
-	if count <= 1 {
-		// No intervals yet, return 0
-		return 0
+// recordInterval feeds the interval closed by event to the history, custom
+// aggregators and exemplars; callers hold mu
+func (m *Metrics) recordInterval(event *proto.Event, intervalMs float64) {
+	if m.history != nil {
+		m.history.record(event.ServerTimestamp, intervalMs)
 	}
-
-	// Collect intervals from consecutive timestamps in the ring buffer
-	samples := make([]float64, 0, count-1) // We have count-1 intervals for count events
-	r := m.Samples
-
-	// Start from the oldest timestamp and work backwards to calculate intervals
-	timestamps := make([]float64, 0, count)
-	for i := 0; i < int(count); i++ {
-		if r.Value != nil {
-			timestamps = append(timestamps, r.Value.(float64))
-		}
-		r = r.Next()
+	if m.heatmap != nil {
+		m.heatmap.record(m, event.ServerTimestamp, intervalMs, sampleWeight(event))
+	}
+	m.recordExemplars(event, intervalMs)
+	for _, a := range m.aggregators {
+		a.Observe(intervalMs)
 	}
+}
 
-	// Calculate intervals between consecutive timestamps
-	for i := 1; i < len(timestamps); i++ {
-		interval := timestamps[i] - timestamps[i-1]
-		if interval >= 0 { // Only include non-negative intervals
-			samples = append(samples, interval)
+func (m *Metrics) calculatePercentile(p float64) float64 {
+	// Collect the intervals in the ring buffer, skipping unfilled slots
+	samples := make([]float64, 0, m.intervals)
+	m.Samples.Do(func(v any) {
+		if v != nil {
+			samples = append(samples, v.(float64))
 		}
-	}
+	})
+
+	return percentile(samples, p)
+}
 
+// percentile returns the p-th percentile of samples, sorting them in place
+func percentile(samples []float64, p float64) float64 {
 	if len(samples) == 0 {
 		return 0
 	}
-	
-	// For a single interval (count == 2), just return it
+
+	// For a single interval, just return it
 	if len(samples) == 1 {
 		return samples[0]
 	}
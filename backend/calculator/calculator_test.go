@@ -11,6 +11,8 @@ import (
 
 	"github.com/elodin/latency-dash/backend/proto"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	protobuf "google.golang.org/protobuf/proto"
 )
 
 const (
@@ -467,3 +469,141 @@ func TestConcurrentAccess(t *testing.T) {
 		})
 	}
 }
+
+func TestJitter(t *testing.T) {
+	update := func(m *Metrics, offsetsMs ...int) {
+		base := time.Now()
+		for _, offset := range offsetsMs {
+			m.Update(&proto.Event{
+				TargetId:        testTargetID,
+				Key:             testKey,
+				ServerTimestamp: base.Add(time.Duration(offset) * time.Millisecond).UnixNano(),
+			})
+		}
+	}
+
+	// A perfectly periodic stream has no jitter
+	periodic := &Metrics{Samples: ring.New(MaxSamples)}
+	update(periodic, 0, 100, 200, 300, 400)
+	assert.Equal(t, 0.0, periodic.Jitter())
+
+	// Intervals of 100, 200, 100ms: J = 100/16, then J += (100 - J)/16
+	alternating := &Metrics{Samples: ring.New(MaxSamples)}
+	update(alternating, 0, 100, 300, 400)
+	assert.InDelta(t, 12.109375, alternating.Jitter(), 0.000001)
+	assert.InDelta(t, 12.109375, alternating.toUpdate().Jitter, 0.000001)
+}
+
+func TestSampleRateWeighting(t *testing.T) {
+	calc := NewMetricsCalculator()
+	first := createTestEvent(testTargetID, testKey, nil)
+	m := calc.createMetric(testTargetID+":"+testKey, first)
+
+	// Ten events 100ms apart, each standing for ten events at the producer
+	base := time.Now()
+	for i := range 10 {
+		event := createTestEvent(testTargetID, testKey, nil)
+		event.ServerTimestamp = base.Add(time.Duration(i*100) * time.Millisecond).UnixNano()
+		event.SampleRate = 0.1
+		m.Update(event)
+	}
+
+	assert.Equal(t, int64(10), m.Count(), "Count reflects received events")
+	assert.InDelta(t, 100.0, m.EstimatedCount(), 0.001)
+	assert.InDelta(t, 100.0, m.Throughput(), 0.001)
+	assert.Equal(t, 100.0, m.P90(), "Percentiles reflect the sampled distribution")
+
+	frames, err := calc.Heatmap(m.ID())
+	require.NoError(t, err)
+	var total float64
+	for _, frame := range frames {
+		for _, c := range frame.Counts {
+			total += c
+		}
+	}
+	assert.InDelta(t, 90.0, total, 0.001, "Nine intervals weighted by ten")
+
+	update := m.toUpdate()
+	assert.InDelta(t, 100.0, update.EstimatedCount, 0.001)
+	assert.InDelta(t, 100.0, update.Throughput, 0.001)
+}
+
+func TestDurationThroughput(t *testing.T) {
+	calc := NewMetricsCalculator()
+	first := createTestEvent(testTargetID, testKey, nil)
+	m := calc.createMetric(testTargetID+":"+testKey, first)
+
+	// Ten duration samples 100ms apart, each standing for ten requests
+	base := time.Now()
+	for i := range 10 {
+		event := createTestEvent(testTargetID, testKey, nil)
+		event.ServerTimestamp = base.Add(time.Duration(i*100) * time.Millisecond).UnixNano()
+		event.SampleRate = 0.1
+		m.ObserveLatency(event, 5)
+	}
+
+	assert.Equal(t, int64(10), m.Count())
+	assert.InDelta(t, 100.0, m.EstimatedCount(), 0.001)
+	assert.InDelta(t, 100.0, m.Throughput(), 0.001)
+}
+
+func TestSampleWeight(t *testing.T) {
+	assert.Equal(t, 1.0, sampleWeight(&proto.Event{}))
+	assert.Equal(t, 4.0, sampleWeight(&proto.Event{SampleRate: 0.25}))
+	assert.Equal(t, 1.0, sampleWeight(&proto.Event{SampleRate: 1}))
+	assert.Equal(t, 1.0, sampleWeight(&proto.Event{SampleRate: 2}), "Invalid rates are ignored")
+	assert.Equal(t, 1.0, sampleWeight(&proto.Event{SampleRate: -0.5}), "Invalid rates are ignored")
+}
+
+func TestValidateEvent(t *testing.T) {
+	valid := func() *proto.Event {
+		return &proto.Event{TargetId: testTargetID, Key: testKey, ServerTimestamp: time.Now().UnixNano()}
+	}
+	require.NoError(t, ValidateEvent(valid()))
+
+	tests := []struct {
+		name   string
+		modify func(*proto.Event)
+	}{
+		{"missing_target", func(e *proto.Event) { e.TargetId = "" }},
+		{"missing_key", func(e *proto.Event) { e.Key = "" }},
+		{"missing_timestamp", func(e *proto.Event) { e.ServerTimestamp = 0 }},
+		{"sample_rate_above_one", func(e *proto.Event) { e.SampleRate = 1.5 }},
+		{"negative_sample_rate", func(e *proto.Event) { e.SampleRate = -0.1 }},
+		{"negative_payload_size", func(e *proto.Event) { e.PayloadSize = -1 }},
+		{"stage_without_job", func(e *proto.Event) { e.Stage = "start" }},
+		{"negative_duration", func(e *proto.Event) { e.DurationNs = protobuf.Int64(-1) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := valid()
+			tt.modify(event)
+			assert.ErrorIs(t, ValidateEvent(event), ErrInvalidEvent)
+		})
+	}
+}
+
+func TestEventDuration(t *testing.T) {
+	calc := NewMetricsCalculator()
+	stop := runCalculator(t, calc)
+	defer stop()
+
+	// Events carrying a duration are latency samples, so even the first one counts
+	base := time.Now()
+	for i, latency := range []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond} {
+		require.NoError(t, calc.ProcessEvent(&proto.Event{
+			TargetId:        testTargetID,
+			Key:             testKey,
+			ServerTimestamp: base.Add(time.Duration(i) * time.Second).UnixNano(),
+			DurationNs:      protobuf.Int64(latency.Nanoseconds()),
+		}))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	updates := calc.GetAllMetrics()
+	require.Len(t, updates, 1)
+	assert.Equal(t, int64(3), updates[0].Count)
+	assert.InDelta(t, 10, updates[0].Min, 0.001)
+	assert.InDelta(t, 30, updates[0].Max, 0.001)
+	assert.InDelta(t, 20, updates[0].Avg, 0.001)
+}
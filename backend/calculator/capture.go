@@ -0,0 +1,286 @@
+package calculator
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+const (
+	// DefaultCaptureFileSize is the size at which a capture file is rotated
+	DefaultCaptureFileSize = 64 << 20
+	// DefaultCaptureFiles is how many files of a capture are kept
+	DefaultCaptureFiles = 10
+
+	// captureQueueSize bounds the events waiting to be written; events are
+	// dropped rather than slowing down ProcessEvent
+	captureQueueSize = 10000
+)
+
+var (
+	ErrCaptureDisabled = errors.New("capture directory not configured")
+	ErrCaptureActive   = errors.New("capture already running")
+	ErrCaptureInactive = errors.New("no capture running")
+)
+
+// captureRecorder writes the events entering ProcessEvent to length-delimited
+// capture files in the background, rotating them by size
+type captureRecorder struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	prefix   string // Of the file names, from the start time
+
+	ch   chan *proto.CapturedEvent
+	done chan struct{} // Closed once the writer has finished
+
+	// Owned by the writer goroutine
+	file *os.File
+	w    *bufio.Writer
+	size int64
+	seq  int
+
+	events  atomic.Int64
+	dropped atomic.Int64
+	bytes   atomic.Int64
+
+	mu        sync.Mutex // Guards the fields below
+	startedAt time.Time
+	stoppedAt time.Time
+	files     []string
+	err       error
+}
+
+// StartCapture starts recording every event entering ProcessEvent to files
+// in Config.CaptureDir, named after the start time. Files are rotated once
+// they reach Config.CaptureFileSize, keeping the latest Config.CaptureFiles.
+func (c *MetricsCalculator) StartCapture() (*proto.CaptureStatus, error) {
+	if c.config.CaptureDir == "" {
+		return nil, ErrCaptureDisabled
+	}
+
+	c.captureMu.Lock()
+	defer c.captureMu.Unlock()
+	if c.capture != nil {
+		return nil, ErrCaptureActive
+	}
+
+	if err := os.MkdirAll(c.config.CaptureDir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating capture directory: %w", err)
+	}
+	now := time.Now()
+	r := &captureRecorder{
+		dir:       c.config.CaptureDir,
+		maxSize:   c.config.CaptureFileSize,
+		maxFiles:  c.config.CaptureFiles,
+		prefix:    "capture-" + now.UTC().Format("20060102T150405.000000000Z"),
+		ch:        make(chan *proto.CapturedEvent, captureQueueSize),
+		done:      make(chan struct{}),
+		startedAt: now,
+	}
+	// Open the first file right away so a bad directory fails here
+	if err := r.rotate(); err != nil {
+		return nil, err
+	}
+	go r.run()
+
+	c.capture = r
+	c.lastCapture = r
+	return r.status(), nil
+}
+
+// StopCapture stops recording and returns once every queued event is written
+func (c *MetricsCalculator) StopCapture() (*proto.CaptureStatus, error) {
+	c.captureMu.Lock()
+	r := c.capture
+	if r == nil {
+		c.captureMu.Unlock()
+		return nil, ErrCaptureInactive
+	}
+	c.capture = nil
+	close(r.ch)
+	c.captureMu.Unlock()
+
+	<-r.done
+	r.mu.Lock()
+	r.stoppedAt = time.Now()
+	r.mu.Unlock()
+	return r.status(), nil
+}
+
+// CaptureStatus describes the running capture, or the latest one if none is
+// running. It returns nil if nothing was ever captured.
+func (c *MetricsCalculator) CaptureStatus() *proto.CaptureStatus {
+	c.captureMu.RLock()
+	r := c.lastCapture
+	c.captureMu.RUnlock()
+	if r == nil {
+		return nil
+	}
+	return r.status()
+}
+
+// captureEvent queues an event for the running capture, if any
+func (c *MetricsCalculator) captureEvent(event *proto.Event, receivedAt time.Time) {
+	c.captureMu.RLock()
+	defer c.captureMu.RUnlock()
+	if c.capture == nil {
+		return
+	}
+
+	select {
+	case c.capture.ch <- &proto.CapturedEvent{ReceivedAt: receivedAt.UnixNano(), Event: event}:
+	default:
+		c.capture.dropped.Add(1)
+	}
+}
+
+func (r *captureRecorder) status() *proto.CaptureStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := &proto.CaptureStatus{
+		Active:    r.stoppedAt.IsZero(),
+		StartedAt: r.startedAt.UnixNano(),
+		Files:     append([]string(nil), r.files...),
+		Events:    r.events.Load(),
+		Dropped:   r.dropped.Load(),
+		Bytes:     r.bytes.Load(),
+	}
+	if !r.stoppedAt.IsZero() {
+		status.StoppedAt = r.stoppedAt.UnixNano()
+	}
+	if r.err != nil {
+		status.Error = r.err.Error()
+	}
+	return status
+}
+
+// run writes queued events until the channel is closed
+func (r *captureRecorder) run() {
+	defer close(r.done)
+	defer r.closeFile()
+
+	for event := range r.ch {
+		r.write(event)
+		// Keep the file current whenever the writer catches up
+		if len(r.ch) == 0 && r.w != nil {
+			if err := r.w.Flush(); err != nil {
+				r.fail(err)
+			}
+		}
+	}
+}
+
+func (r *captureRecorder) write(event *proto.CapturedEvent) {
+	if r.file == nil {
+		if err := r.rotate(); err != nil {
+			r.dropped.Add(1)
+			return
+		}
+	}
+
+	n, err := protodelim.MarshalTo(r.w, event)
+	r.size += int64(n)
+	r.bytes.Add(int64(n))
+	if err != nil {
+		r.dropped.Add(1)
+		r.fail(err)
+		return
+	}
+	r.events.Add(1)
+
+	if r.size >= r.maxSize {
+		// A failure is recorded and retried by the next event
+		r.rotate()
+	}
+}
+
+// rotate closes the current file, opens the next one and removes the oldest
+// files beyond maxFiles
+func (r *captureRecorder) rotate() error {
+	r.closeFile()
+
+	r.seq++
+	path := filepath.Join(r.dir, fmt.Sprintf("%s-%04d.pb", r.prefix, r.seq))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		err = fmt.Errorf("creating capture file: %w", err)
+		r.fail(err)
+		return err
+	}
+	r.file, r.w, r.size = file, bufio.NewWriter(file), 0
+
+	r.mu.Lock()
+	r.files = append(r.files, path)
+	var expired []string
+	if len(r.files) > r.maxFiles {
+		expired = r.files[:len(r.files)-r.maxFiles]
+		r.files = append([]string(nil), r.files[len(r.files)-r.maxFiles:]...)
+	}
+	r.mu.Unlock()
+
+	for _, path := range expired {
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove capture file: %v", err)
+		}
+	}
+	return nil
+}
+
+// closeFile flushes and closes the current file, if any
+func (r *captureRecorder) closeFile() {
+	if r.file == nil {
+		return
+	}
+	err := r.w.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file, r.w = nil, nil
+	if err != nil {
+		r.fail(err)
+	}
+}
+
+// fail records a write error. The current file is abandoned so the next
+// event starts a new one.
+func (r *captureRecorder) fail(err error) {
+	log.Printf("Capture error: %v", err)
+	r.mu.Lock()
+	r.err = err
+	r.mu.Unlock()
+	if r.file != nil {
+		r.file.Close()
+		r.file, r.w = nil, nil
+	}
+}
+
+// ReadCapture calls fn with every event of a capture file in order, stopping
+// at the first error fn returns
+func ReadCapture(reader io.Reader, fn func(*proto.CapturedEvent) error) error {
+	buffered := bufio.NewReader(reader)
+	for {
+		var event proto.CapturedEvent
+		err := protodelim.UnmarshalFrom(buffered, &event)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading capture: %w", err)
+		}
+		if err := fn(&event); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package calculator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// readCaptureFiles reads the events of capture files in order
+func readCaptureFiles(t *testing.T, paths []string) []*proto.CapturedEvent {
+	t.Helper()
+	var events []*proto.CapturedEvent
+	for _, path := range paths {
+		file, err := os.Open(path)
+		require.NoError(t, err)
+		require.NoError(t, ReadCapture(file, func(event *proto.CapturedEvent) error {
+			events = append(events, event)
+			return nil
+		}))
+		file.Close()
+	}
+	return events
+}
+
+func TestCapture(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "captures")
+	calc := NewMetricsCalculatorWithConfig(Config{CaptureDir: dir})
+	assert.Nil(t, calc.CaptureStatus())
+
+	_, err := calc.StopCapture()
+	assert.ErrorIs(t, err, ErrCaptureInactive)
+
+	// Events before the capture starts aren't recorded
+	require.NoError(t, calc.ProcessEvent(&proto.Event{TargetId: "test-target", Key: "before", ServerTimestamp: 1}))
+
+	status, err := calc.StartCapture()
+	require.NoError(t, err)
+	assert.True(t, status.Active)
+	require.Len(t, status.Files, 1)
+	_, err = calc.StartCapture()
+	assert.ErrorIs(t, err, ErrCaptureActive)
+
+	start := time.Now()
+	var sent []*proto.Event
+	for i := range 5 {
+		durationNs := int64(i) * int64(time.Millisecond)
+		event := &proto.Event{
+			TargetId:        "test-target",
+			Key:             "test-key",
+			ServerTimestamp: int64(i + 1),
+			Metadata:        map[string]string{"region": "us"},
+			DurationNs:      &durationNs,
+		}
+		sent = append(sent, event)
+		// The calculator isn't running, but queued events are recorded too
+		require.NoError(t, calc.ProcessEvent(event))
+	}
+
+	status, err = calc.StopCapture()
+	require.NoError(t, err)
+	assert.False(t, status.Active)
+	assert.Equal(t, int64(5), status.Events)
+	assert.Zero(t, status.Dropped)
+	assert.Empty(t, status.Error)
+	assert.GreaterOrEqual(t, status.StoppedAt, status.StartedAt)
+	assert.Equal(t, status, calc.CaptureStatus())
+
+	info, err := os.Stat(status.Files[0])
+	require.NoError(t, err)
+	assert.Equal(t, status.Bytes, info.Size())
+
+	captured := readCaptureFiles(t, status.Files)
+	require.Len(t, captured, len(sent))
+	for i, event := range captured {
+		assert.True(t, protobuf.Equal(sent[i], event.Event), "event %d", i)
+		assert.GreaterOrEqual(t, event.ReceivedAt, start.UnixNano())
+	}
+
+	// A new capture writes new files
+	next, err := calc.StartCapture()
+	require.NoError(t, err)
+	assert.NotEqual(t, status.Files, next.Files)
+	calc.Close()
+	assert.False(t, calc.CaptureStatus().Active)
+}
+
+func TestCaptureRotation(t *testing.T) {
+	dir := t.TempDir()
+	calc := NewMetricsCalculatorWithConfig(Config{CaptureDir: dir, CaptureFileSize: 200, CaptureFiles: 3})
+
+	_, err := calc.StartCapture()
+	require.NoError(t, err)
+	for i := range 50 {
+		require.NoError(t, calc.ProcessEvent(&proto.Event{
+			TargetId:        "test-target",
+			Key:             "test-key",
+			ServerTimestamp: int64(i + 1),
+		}))
+	}
+	status, err := calc.StopCapture()
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), status.Events)
+
+	// Only the latest files are kept, each about the size limit
+	require.Len(t, status.Files, 3)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+	for _, path := range status.Files[:2] {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, info.Size(), int64(200))
+		assert.Less(t, info.Size(), int64(300))
+	}
+
+	// The kept files hold the latest events, in order
+	captured := readCaptureFiles(t, status.Files)
+	require.NotEmpty(t, captured)
+	assert.Equal(t, int64(50), captured[len(captured)-1].Event.ServerTimestamp)
+	for i := 1; i < len(captured); i++ {
+		assert.Equal(t, captured[i-1].Event.ServerTimestamp+1, captured[i].Event.ServerTimestamp)
+	}
+}
+
+func TestCaptureDisabled(t *testing.T) {
+	calc := NewMetricsCalculator()
+	_, err := calc.StartCapture()
+	assert.ErrorIs(t, err, ErrCaptureDisabled)
+
+	// A directory that can't be created fails the start
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o644))
+	calc = NewMetricsCalculatorWithConfig(Config{CaptureDir: filepath.Join(file, "captures")})
+	_, err = calc.StartCapture()
+	assert.Error(t, err)
+	assert.Nil(t, calc.CaptureStatus())
+}
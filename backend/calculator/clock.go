@@ -0,0 +1,189 @@
+package calculator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const (
+	// ClockWindow is the number of recent deliveries per target used to
+	// estimate its clock offset and drift
+	ClockWindow = 64
+
+	// minClockSamples is how many deliveries a fresh estimate needs before
+	// clock steps are detected against it
+	minClockSamples = 8
+
+	// minClockSpan is how long the samples must span before drift is
+	// estimated; over shorter spans receive jitter dominates the slope
+	minClockSpan = 1 * time.Second
+
+	// clockDeliveryWindow groups events received this close to each other
+	// into one delivery, such as the events of one batch
+	clockDeliveryWindow = 50 * time.Millisecond
+)
+
+// clockSample is one delivery: the events of a target received together.
+// Producers that buffer events send them late, but never early, so the
+// freshest event of a delivery, the one with the highest offset, is the
+// closest to the producer's clock.
+type clockSample struct {
+	received int64   // Receive time of the first event in nanoseconds
+	offset   float64 // Highest offset of the events, in milliseconds
+	spread   float64 // How far the offsets of the events reach below offset
+}
+
+// clockEstimator fits a line through the offsets of a target's recent
+// deliveries. The intercept at the latest sample is the current offset and
+// the slope is the drift of the producer's clock against ours.
+type clockEstimator struct {
+	mu sync.Mutex
+
+	samples []clockSample // Oldest first
+	offset  float64       // Milliseconds, at the latest sample
+	slope   float64       // Milliseconds of offset per second
+
+	steps    int64
+	lastStep int64 // Receive time in nanoseconds
+	epoch    int64 // Incremented on every step
+}
+
+// observe adds the offset of an event received at received and returns the
+// updated offset estimate along with the clock epoch. An event ahead of the
+// prediction by more than threshold is a step, as is one behind it by more
+// than threshold beyond the spread seen within recent deliveries, which
+// allows for events buffered by the producer. A step is counted, the
+// estimate restarts from this event and the epoch moves on. A zero threshold
+// disables step detection.
+func (e *clockEstimator) observe(received int64, offset, threshold float64) (float64, int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if threshold > 0 && len(e.samples) >= minClockSamples {
+		predicted := e.predict(received)
+		if offset > predicted+threshold || offset < predicted-threshold-e.spread() {
+			e.steps++
+			e.lastStep = received
+			e.epoch++
+			e.samples = e.samples[:0]
+		}
+	}
+
+	if n := len(e.samples); n > 0 && received-e.samples[n-1].received < int64(clockDeliveryWindow) {
+		// Another event of the latest delivery
+		last := &e.samples[n-1]
+		if offset > last.offset {
+			last.spread += offset - last.offset
+			last.offset = offset
+		} else {
+			last.spread = max(last.spread, last.offset-offset)
+		}
+	} else {
+		if len(e.samples) == ClockWindow {
+			e.samples = append(e.samples[:0], e.samples[1:]...)
+		}
+		e.samples = append(e.samples, clockSample{received: received, offset: offset})
+	}
+	e.fit()
+	return e.offset, e.epoch
+}
+
+// spread is the widest range of offsets within a recent delivery; callers
+// hold mu
+func (e *clockEstimator) spread() float64 {
+	var spread float64
+	for _, s := range e.samples {
+		spread = max(spread, s.spread)
+	}
+	return spread
+}
+
+// current returns the offset estimate and clock epoch without a new sample
+func (e *clockEstimator) current() (float64, int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.offset, e.epoch
+}
+
+// predict extrapolates the offset to a receive time; callers hold mu
+func (e *clockEstimator) predict(received int64) float64 {
+	last := e.samples[len(e.samples)-1].received
+	return e.offset + e.slope*time.Duration(received-last).Seconds()
+}
+
+// fit runs a least-squares regression of offset over receive time; callers
+// hold mu
+func (e *clockEstimator) fit() {
+	n := float64(len(e.samples))
+	base := e.samples[0].received
+
+	var sumX, sumY float64
+	for _, s := range e.samples {
+		sumX += time.Duration(s.received - base).Seconds()
+		sumY += s.offset
+	}
+	meanX, meanY := sumX/n, sumY/n
+
+	var sxx, sxy float64
+	for _, s := range e.samples {
+		dx := time.Duration(s.received-base).Seconds() - meanX
+		sxx += dx * dx
+		sxy += dx * (s.offset - meanY)
+	}
+
+	e.slope = 0
+	lastX := time.Duration(e.samples[len(e.samples)-1].received - base).Seconds()
+	if sxx > 0 && lastX >= minClockSpan.Seconds() {
+		e.slope = sxy / sxx
+	}
+	e.offset = meanY + e.slope*(lastX-meanX)
+}
+
+// stats fills in the clock fields of a target's stats
+func (e *clockEstimator) stats(stats *proto.TargetStats) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	stats.ClockOffset = e.offset
+	// Milliseconds per second is parts per thousand
+	stats.ClockDriftPpm = e.slope * 1000
+	stats.ClockSteps = e.steps
+	stats.LastClockStep = e.lastStep
+}
+
+// restore loads persisted step counters; the estimate itself is relearned
+func (e *clockEstimator) restore(stats *proto.TargetStats) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.steps = stats.ClockSteps
+	e.lastStep = stats.LastClockStep
+}
+
+// trackClock feeds an event into its target's clock estimate. It returns the
+// event to process, with its timestamp corrected if Config.ClockCorrection
+// is set, and the target's clock epoch. Events with a duration aren't fed
+// in: they are timestamped at the start or end of the measured operation,
+// which may be long before they are sent, as with spans exported in
+// batches or probes sent once they complete.
+func (c *MetricsCalculator) trackClock(event *proto.Event, receivedAt time.Time) (*proto.Event, int64) {
+	t := c.target(event.TargetId)
+
+	var estimate float64
+	var epoch int64
+	if event.DurationNs != nil {
+		estimate, epoch = t.clock.current()
+	} else {
+		received := receivedAt.UnixNano()
+		offset := float64(event.ServerTimestamp-received) / float64(time.Millisecond)
+		threshold := float64(c.config.ClockStepThreshold) / float64(time.Millisecond)
+		estimate, epoch = t.clock.observe(received, offset, threshold)
+	}
+	if c.config.ClockCorrection {
+		// The event may be shared with the producer, so correct a copy
+		event = protobuf.Clone(event).(*proto.Event)
+		event.ServerTimestamp -= int64(estimate * float64(time.Millisecond))
+	}
+	return event, epoch
+}
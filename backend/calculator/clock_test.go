@@ -0,0 +1,209 @@
+package calculator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClockEstimatorDrift(t *testing.T) {
+	var e clockEstimator
+	base := time.Now().UnixNano()
+
+	// The producer runs 500ms ahead and gains 100µs per second (100 ppm)
+	var estimate float64
+	for i := 0; i < 100; i++ {
+		received := base + int64(i)*int64(100*time.Millisecond)
+		elapsed := time.Duration(received - base).Seconds()
+		estimate, _ = e.observe(received, 500+0.1*elapsed, 0)
+	}
+
+	assert.InDelta(t, 500+0.1*9.9, estimate, 1e-6)
+	stats := &proto.TargetStats{}
+	e.stats(stats)
+	assert.InDelta(t, 500+0.1*9.9, stats.ClockOffset, 1e-6)
+	assert.InDelta(t, 100, stats.ClockDriftPpm, 1e-3)
+	assert.Equal(t, int64(0), stats.ClockSteps)
+}
+
+func TestClockEstimatorNoDriftOverShortSpan(t *testing.T) {
+	var e clockEstimator
+	base := time.Now().UnixNano()
+
+	// Receive jitter over a fraction of a second must not read as drift
+	e.observe(base, 10, 0)
+	estimate, _ := e.observe(base+int64(100*time.Millisecond), 12, 0)
+	assert.Equal(t, 11.0, estimate)
+	assert.Equal(t, 0.0, e.slope)
+}
+
+func TestClockEstimatorDeliveries(t *testing.T) {
+	var e clockEstimator
+	base := time.Now().UnixNano()
+
+	// Events received together are one delivery, at its freshest offset
+	e.observe(base, -300, 0)
+	e.observe(base+1000, -100, 0)
+	estimate, _ := e.observe(base+2000, -200, 0)
+	assert.Equal(t, -100.0, estimate)
+	require.Len(t, e.samples, 1)
+	assert.Equal(t, 200.0, e.samples[0].spread)
+}
+
+// sendBatches has a producer with a correct clock send batches of events
+// 250ms apart every 5s, the newest taken just before sending, and returns
+// the receive time of the next batch
+func sendBatches(calc *MetricsCalculator, base time.Time, batches int, step time.Duration) time.Time {
+	received := base
+	for b := range batches {
+		received = base.Add(time.Duration(b) * 5 * time.Second)
+		for i := range 20 {
+			taken := received.Add(-time.Duration(19-i) * 250 * time.Millisecond).Add(-5 * time.Millisecond)
+			event := createTestEvent("a", testKey, nil)
+			event.ServerTimestamp = taken.Add(step).UnixNano()
+			// Network jitter of a few milliseconds between batches
+			calc.handleEvent(event, received.Add(time.Duration(b%3)*time.Millisecond+time.Duration(i)*time.Microsecond))
+		}
+	}
+	return received.Add(5 * time.Second)
+}
+
+func TestClockBatchedProducer(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{ClockStepThreshold: time.Second})
+	base := time.Now()
+	sendBatches(calc, base, 20, 0)
+
+	stats := calc.TargetStats()
+	require.Len(t, stats, 1)
+	assert.Zero(t, stats[0].ClockSteps, "Batches are not clock steps")
+	assert.InDelta(t, -5, stats[0].ClockOffset, 5)
+
+	m, exists := calc.metric(seriesKey("a", testKey, map[string]string{"tier": testTier}))
+	require.True(t, exists)
+	assert.Equal(t, int64(399), m.intervals, "No interval is discarded")
+	assert.InDelta(t, 250.0, m.Max(), 1e-3)
+}
+
+func TestClockBatchedProducerSteps(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		step time.Duration
+	}{
+		{"ahead", time.Hour},
+		{"behind", -time.Hour},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			calc := NewMetricsCalculatorWithConfig(Config{ClockStepThreshold: time.Second})
+			base := time.Now()
+			next := sendBatches(calc, base, 10, 0)
+			sendBatches(calc, next, 10, tt.step)
+
+			stats := calc.TargetStats()
+			require.Len(t, stats, 1)
+			assert.Equal(t, int64(1), stats[0].ClockSteps)
+			assert.Equal(t, next.UnixNano(), stats[0].LastClockStep)
+		})
+	}
+}
+
+func TestClockStepDiscardsInterval(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{ClockStepThreshold: time.Second})
+	base := time.Now()
+
+	received := base
+	timestamp := base
+	send := func() {
+		event := createTestEvent("a", testKey, nil)
+		event.ServerTimestamp = timestamp.UnixNano()
+		calc.handleEvent(event, received)
+		received = received.Add(100 * time.Millisecond)
+		timestamp = timestamp.Add(100 * time.Millisecond)
+	}
+	for i := 0; i < 20; i++ {
+		send()
+	}
+
+	// NTP steps the producer's clock an hour ahead
+	timestamp = timestamp.Add(time.Hour)
+	send()
+	send()
+
+	m, exists := calc.metric(seriesKey("a", testKey, map[string]string{"tier": testTier}))
+	require.True(t, exists)
+	assert.Equal(t, int64(22), m.Count())
+	assert.InDelta(t, 100.0, m.Max(), 1e-3, "The interval spanning the step is discarded")
+	assert.InDelta(t, 100.0, m.Avg(), 1e-3)
+
+	stats := calc.TargetStats()
+	require.Len(t, stats, 1)
+	assert.Equal(t, int64(1), stats[0].ClockSteps)
+	assert.Equal(t, base.Add(20*100*time.Millisecond).UnixNano(), stats[0].LastClockStep)
+	assert.InDelta(t, float64(time.Hour/time.Millisecond), stats[0].ClockOffset, 1e-6)
+}
+
+func TestClockStepDetectionDisabled(t *testing.T) {
+	calc := NewMetricsCalculator()
+	base := time.Now()
+
+	for i := 0; i < 20; i++ {
+		event := createTestEvent("a", testKey, nil)
+		event.ServerTimestamp = base.Add(time.Duration(i) * 100 * time.Millisecond).UnixNano()
+		if i == 19 {
+			// A backfill far from receive time is taken as is
+			event.ServerTimestamp += int64(time.Hour)
+		}
+		calc.handleEvent(event, base.Add(time.Duration(i)*100*time.Millisecond))
+	}
+
+	stats := calc.TargetStats()
+	require.Len(t, stats, 1)
+	assert.Equal(t, int64(0), stats[0].ClockSteps)
+}
+
+func TestClockCorrection(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{ClockCorrection: true})
+	base := time.Now()
+
+	// The producer's clock is 10s behind ours
+	var last int64
+	for i := 0; i < 10; i++ {
+		received := base.Add(time.Duration(i) * 100 * time.Millisecond)
+		event := createTestEvent("a", testKey, nil)
+		event.ServerTimestamp = received.Add(-10 * time.Second).UnixNano()
+		original := event.ServerTimestamp
+		calc.handleEvent(event, received)
+		assert.Equal(t, original, event.ServerTimestamp, "The producer's event is not modified")
+		last = received.UnixNano()
+	}
+
+	m, exists := calc.metric(seriesKey("a", testKey, map[string]string{"tier": testTier}))
+	require.True(t, exists)
+	assert.InDelta(t, 100.0, m.Avg(), 1e-3)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	assert.InDelta(t, last, m.lastTimestamp, float64(time.Millisecond), "Timestamps are shifted onto our clock")
+}
+
+func TestClockIgnoresDurations(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{ClockStepThreshold: time.Second})
+	base := time.Now()
+
+	// A probe every 10s, timestamped when it starts and sent once it
+	// completes, sometimes only after a timeout
+	for i := range 20 {
+		started := base.Add(time.Duration(i) * 10 * time.Second)
+		duration := time.Duration(i%4) * 1500 * time.Millisecond
+		durationNs := duration.Nanoseconds()
+		event := createTestEvent("probes", testKey, nil)
+		event.ServerTimestamp = started.UnixNano()
+		event.DurationNs = &durationNs
+		calc.handleEvent(event, started.Add(duration))
+	}
+
+	stats := calc.TargetStats()
+	require.Len(t, stats, 1)
+	assert.Zero(t, stats[0].ClockSteps)
+}
@@ -0,0 +1,209 @@
+package calculator
+
+import (
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+const (
+	// ComparisonReferenceKey is the metadata key naming the reference target
+	// of a comparison series
+	ComparisonReferenceKey = "reference"
+	// ComparisonTargetKey is the metadata key naming the compared target
+	ComparisonTargetKey = "target"
+)
+
+// ComparisonConfig declares derived series that compare the same keys across
+// targets. Every target after the first is compared against the first one,
+// producing one series per key and compared target.
+type ComparisonConfig struct {
+	Name    string   // Target ID of the derived series
+	Targets []string // Reference target first, then the targets compared to it
+	Keys    []string // Keys to compare; empty compares every key
+}
+
+func (cfg *ComparisonConfig) covers(targetID, key string) bool {
+	if len(cfg.Targets) < 2 {
+		return false
+	}
+	if len(cfg.Keys) > 0 && !slices.Contains(cfg.Keys, key) {
+		return false
+	}
+	return slices.Contains(cfg.Targets, targetID)
+}
+
+// combinedStats merges the metadata variants of a target + key
+type combinedStats struct {
+	count      int64
+	avg        float64
+	p90        float64
+	aggregates map[string]Aggregator
+}
+
+// combinedStatsLocked merges every series of a target + key. The average
+// is weighted by the intervals of each series, while the P90 is taken over
+// their sample rings together and the aggregators are merged. Callers hold
+// metricsMu.
+func (c *MetricsCalculator) combinedStatsLocked(targetID, key string) (combinedStats, bool) {
+	var stats combinedStats
+	var avgSum float64
+	var intervals int64
+	var samples []float64
+	for _, m := range c.byKey[targetID+":"+key] {
+		n, ring := m.intervalSamples()
+		if n == 0 {
+			continue
+		}
+		stats.count += m.Count()
+		intervals += n
+		avgSum += m.Avg() * float64(n)
+		samples = append(samples, ring...)
+		if stats.aggregates == nil {
+			stats.aggregates = c.newAggregators(targetID, key)
+		}
+		m.mergeAggregators(stats.aggregates)
+	}
+	if intervals == 0 {
+		return stats, false
+	}
+	stats.avg = avgSum / float64(intervals)
+	stats.p90 = percentile(samples, P90Percentile)
+	return stats, true
+}
+
+// intervalSamples returns how many intervals the series observed, along
+// with those still in its sample ring
+func (m *Metrics) intervalSamples() (int64, []float64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	samples := make([]float64, 0, min(m.intervals, MaxSamples))
+	m.Samples.Do(func(v any) {
+		if v != nil {
+			samples = append(samples, v.(float64))
+		}
+	})
+	return m.intervals, samples
+}
+
+// comparisonUpdates returns the comparison series affected by a change to
+// the given target + key
+func (c *MetricsCalculator) comparisonUpdates(targetID, key string) []*proto.MetricsUpdate {
+	if len(c.config.Comparisons) == 0 {
+		return nil
+	}
+
+	c.metricsMu.RLock()
+	defer c.metricsMu.RUnlock()
+
+	var updates []*proto.MetricsUpdate
+	for i := range c.config.Comparisons {
+		cfg := &c.config.Comparisons[i]
+		if !cfg.covers(targetID, key) {
+			continue
+		}
+		for _, other := range cfg.Targets[1:] {
+			// A change to the reference affects every pair, otherwise only one
+			if targetID != cfg.Targets[0] && targetID != other {
+				continue
+			}
+			if update, ok := c.comparisonLocked(cfg, key, other); ok {
+				updates = append(updates, update)
+			}
+		}
+	}
+	return updates
+}
+
+// allComparisonsLocked returns every comparison series that currently has
+// data. Callers hold metricsMu.
+func (c *MetricsCalculator) allComparisonsLocked() []*proto.MetricsUpdate {
+	var updates []*proto.MetricsUpdate
+	for i := range c.config.Comparisons {
+		cfg := &c.config.Comparisons[i]
+		if len(cfg.Targets) < 2 {
+			continue
+		}
+		for _, key := range c.comparisonKeysLocked(cfg) {
+			for _, other := range cfg.Targets[1:] {
+				if update, ok := c.comparisonLocked(cfg, key, other); ok {
+					updates = append(updates, update)
+				}
+			}
+		}
+	}
+	return updates
+}
+
+// comparisonKeysLocked lists the keys a comparison covers. Without explicit
+// keys, every key seen for the reference target is compared.
+func (c *MetricsCalculator) comparisonKeysLocked(cfg *ComparisonConfig) []string {
+	if len(cfg.Keys) > 0 {
+		return cfg.Keys
+	}
+	var keys []string
+	for _, series := range c.byKey {
+		if len(series) > 0 && series[0].TargetID == cfg.Targets[0] {
+			keys = append(keys, series[0].Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// comparisonLocked builds the comparison series of key between the reference
+// target and other. The avg, p90 and aggregates of the update hold the
+// absolute deltas.
+func (c *MetricsCalculator) comparisonLocked(cfg *ComparisonConfig, key, other string) (*proto.MetricsUpdate, bool) {
+	reference := cfg.Targets[0]
+	refStats, ok := c.combinedStatsLocked(reference, key)
+	if !ok {
+		return nil, false
+	}
+	otherStats, ok := c.combinedStatsLocked(other, key)
+	if !ok {
+		return nil, false
+	}
+
+	delta := &proto.SeriesDelta{
+		ReferenceTargetId: reference,
+		TargetId:          other,
+		AvgDelta:          otherStats.avg - refStats.avg,
+		P90Delta:          otherStats.p90 - refStats.p90,
+	}
+	if refStats.avg != 0 {
+		delta.AvgRatio = delta.AvgDelta / refStats.avg
+	}
+	if refStats.p90 != 0 {
+		delta.P90Ratio = delta.P90Delta / refStats.p90
+	}
+
+	var aggregates map[string]float64
+	for name, a := range otherStats.aggregates {
+		if ref, ok := refStats.aggregates[name]; ok {
+			if aggregates == nil {
+				aggregates = make(map[string]float64)
+			}
+			aggregates[name] = a.Snapshot() - ref.Snapshot()
+		}
+	}
+
+	metadata := map[string]string{
+		ComparisonReferenceKey: reference,
+		ComparisonTargetKey:    other,
+	}
+	return &proto.MetricsUpdate{
+		TargetId:    cfg.Name,
+		Key:         key,
+		Avg:         delta.AvgDelta,
+		P90:         delta.P90Delta,
+		Count:       min(refStats.count, otherStats.count),
+		LastUpdated: time.Now().UnixNano(),
+		Metadata:    metadata,
+		SeriesId:    seriesKey(cfg.Name, key, metadata),
+		Comparison:  delta,
+		Aggregates:  aggregates,
+	}, true
+}
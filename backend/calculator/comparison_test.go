@@ -0,0 +1,124 @@
+package calculator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendIntervals feeds events for a target + key spaced by the given interval
+func sendIntervals(t *testing.T, calc *MetricsCalculator, targetID, key string, interval time.Duration, n int) {
+	t.Helper()
+	base := time.Now()
+	for i := range n {
+		event := createTestEvent(targetID, key, map[string]string{"region": targetID})
+		event.ServerTimestamp = base.Add(time.Duration(i) * interval).UnixNano()
+		require.NoError(t, calc.ProcessEvent(event))
+	}
+}
+
+func TestComparisonSeries(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{
+		Comparisons: []ComparisonConfig{
+			{Name: "east-vs-west", Targets: []string{"east", "west"}},
+		},
+	})
+	sub := calc.Subscribe()
+	stop := runCalculator(t, calc)
+	defer stop()
+
+	sendIntervals(t, calc, "east", testKey, 100*time.Millisecond, 5)
+	sendIntervals(t, calc, "west", testKey, 150*time.Millisecond, 5)
+	sendIntervals(t, calc, "west", "other-key", 150*time.Millisecond, 5)
+
+	// The last comparison update reflects both targets in full
+	var last *proto.MetricsUpdate
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case update := <-sub:
+			if update.Comparison != nil {
+				last = update
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+
+	require.NotNil(t, last, "Should receive comparison updates")
+	assert.Equal(t, "east-vs-west", last.TargetId)
+	assert.Equal(t, testKey, last.Key)
+	assert.Equal(t, "east", last.Metadata[ComparisonReferenceKey])
+	assert.Equal(t, "west", last.Metadata[ComparisonTargetKey])
+	assert.InDelta(t, 50.0, last.Comparison.AvgDelta, 0.001)
+	assert.InDelta(t, 0.5, last.Comparison.AvgRatio, 0.001)
+	assert.InDelta(t, 50.0, last.Avg, 0.001)
+	assert.InDelta(t, 50.0, last.Comparison.P90Delta, 0.001)
+
+	// Snapshots include comparison series; keys without a reference are skipped
+	var comparisons []*proto.MetricsUpdate
+	for _, update := range calc.GetAllMetrics() {
+		if update.Comparison != nil {
+			comparisons = append(comparisons, update)
+		}
+	}
+	require.Len(t, comparisons, 1)
+	assert.Equal(t, last.SeriesId, comparisons[0].SeriesId)
+}
+
+func TestComparisonCombinesVariants(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{
+		Comparisons: []ComparisonConfig{
+			{Name: "east-vs-west", Targets: []string{"east", "west"}},
+		},
+		Aggregators: []AggregatorConfig{
+			{Name: "over_200ms", New: NewCountOverBudget(200)},
+		},
+	})
+	stop := runCalculator(t, calc)
+	defer stop()
+
+	// The reference has a fast and a slow variant with as many intervals each
+	base := time.Now()
+	for region, interval := range map[string]time.Duration{"a": 100 * time.Millisecond, "b": 300 * time.Millisecond} {
+		for i := range 6 {
+			event := createTestEvent("east", testKey, map[string]string{"region": region})
+			event.ServerTimestamp = base.Add(time.Duration(i) * interval).UnixNano()
+			require.NoError(t, calc.ProcessEvent(event))
+		}
+	}
+	// A single duration sample is enough to compare against
+	duration := int64(400 * time.Millisecond)
+	event := createTestEvent("west", testKey, nil)
+	event.DurationNs = &duration
+	require.NoError(t, calc.ProcessEvent(event))
+	time.Sleep(shortWait)
+
+	var comparison *proto.MetricsUpdate
+	for _, update := range calc.GetAllMetrics() {
+		if update.Comparison != nil {
+			comparison = update
+		}
+	}
+	require.NotNil(t, comparison)
+	assert.InDelta(t, 200.0, comparison.Comparison.AvgDelta, 0.001)
+	// The P90 of the merged samples is the slow variant's, not the mean of the two
+	assert.InDelta(t, 100.0, comparison.Comparison.P90Delta, 0.001)
+	assert.Equal(t, int64(1), comparison.Count)
+	// Aggregators are merged across variants before comparing
+	assert.Equal(t, map[string]float64{"over_200ms": -4}, comparison.Aggregates)
+}
+
+func TestComparisonConfigCovers(t *testing.T) {
+	cfg := ComparisonConfig{Name: "cmp", Targets: []string{"a", "b"}, Keys: []string{"k1"}}
+	assert.True(t, cfg.covers("a", "k1"))
+	assert.True(t, cfg.covers("b", "k1"))
+	assert.False(t, cfg.covers("b", "k2"))
+	assert.False(t, cfg.covers("c", "k1"))
+
+	single := ComparisonConfig{Name: "cmp", Targets: []string{"a"}}
+	assert.False(t, single.covers("a", "k1"), "A single target has nothing to compare against")
+}
@@ -0,0 +1,57 @@
+package calculator
+
+import (
+	"time"
+)
+
+const (
+	// DefaultDedupCapacity bounds the dedup cache when Config.DedupCapacity
+	// is not set
+	DefaultDedupCapacity = 100000
+)
+
+type dedupEntry struct {
+	key  string
+	seen int64 // Unix nanoseconds
+}
+
+// dedupCache remembers recently seen event IDs for a time window, bounded
+// to a maximum number of entries. It is only used from the calculator
+// goroutine and needs no locking.
+type dedupCache struct {
+	window   int64
+	capacity int
+
+	seen  map[string]int64
+	order []dedupEntry // Oldest first
+}
+
+func newDedupCache(window time.Duration, capacity int) *dedupCache {
+	return &dedupCache{
+		window:   int64(window),
+		capacity: capacity,
+		seen:     make(map[string]int64),
+	}
+}
+
+// isDuplicate reports whether key was seen within the window, remembering it
+// otherwise
+func (d *dedupCache) isDuplicate(key string, now time.Time) bool {
+	nowNs := now.UnixNano()
+
+	// Expire entries that left the window or exceed the capacity
+	expired := 0
+	for expired < len(d.order) &&
+		(d.order[expired].seen <= nowNs-d.window || len(d.order)-expired >= d.capacity) {
+		delete(d.seen, d.order[expired].key)
+		expired++
+	}
+	d.order = d.order[expired:]
+
+	if _, exists := d.seen[key]; exists {
+		return true
+	}
+	d.seen[key] = nowNs
+	d.order = append(d.order, dedupEntry{key: key, seen: nowNs})
+	return false
+}
@@ -0,0 +1,67 @@
+package calculator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupCacheWindow(t *testing.T) {
+	d := newDedupCache(time.Minute, 10)
+	now := time.Now()
+
+	assert.False(t, d.isDuplicate("a", now))
+	assert.True(t, d.isDuplicate("a", now.Add(30*time.Second)))
+	assert.False(t, d.isDuplicate("b", now.Add(30*time.Second)))
+
+	// "a" has left the window, "b" has not
+	assert.False(t, d.isDuplicate("a", now.Add(61*time.Second)))
+	assert.True(t, d.isDuplicate("b", now.Add(61*time.Second)))
+}
+
+func TestDedupCacheCapacity(t *testing.T) {
+	d := newDedupCache(time.Hour, 3)
+	now := time.Now()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		assert.False(t, d.isDuplicate(key, now))
+	}
+	assert.Len(t, d.seen, 3)
+	assert.False(t, d.isDuplicate("a", now), "The oldest entry was evicted")
+	assert.True(t, d.isDuplicate("d", now))
+}
+
+func TestDuplicateEventsDropped(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{DedupWindow: time.Minute})
+	stop := runCalculator(t, calc)
+	defer stop()
+
+	base := time.Now()
+	send := func(targetID, eventID string, offset time.Duration) {
+		event := createTestEvent(targetID, testKey, nil)
+		event.ServerTimestamp = base.Add(offset).UnixNano()
+		event.EventId = eventID
+		require.NoError(t, calc.ProcessEvent(event))
+	}
+	send("a", "evt-1", 0)
+	send("a", "evt-1", time.Millisecond) // retry
+	send("a", "evt-2", 100*time.Millisecond)
+	send("b", "evt-1", 0) // same ID on another target is not a duplicate
+	send("a", "", 200*time.Millisecond)
+	send("a", "", 200*time.Millisecond) // no ID, never deduplicated
+	time.Sleep(shortWait)
+
+	m, exists := calc.metric(seriesKey("a", testKey, map[string]string{"tier": testTier}))
+	require.True(t, exists)
+	assert.Equal(t, int64(4), m.Count())
+	assert.Equal(t, 0.0, m.Min(), "Only the ID-less events produce a zero interval")
+
+	stats := calc.TargetStats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, "a", stats[0].TargetId)
+	assert.Equal(t, int64(1), stats[0].Duplicates)
+	assert.Equal(t, "b", stats[1].TargetId)
+	assert.Equal(t, int64(0), stats[1].Duplicates)
+}
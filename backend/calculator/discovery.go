@@ -0,0 +1,84 @@
+package calculator
+
+import (
+	"sort"
+
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+// discoveryTarget counts the series of a target by key and by metadata
+// dimension value
+type discoveryTarget struct {
+	series     int64
+	keys       map[string]int64
+	dimensions map[string]map[string]int64
+}
+
+// discoveryIndex is kept up to date as series are registered; it is guarded
+// by metricsMu
+type discoveryIndex map[string]*discoveryTarget
+
+func (d discoveryIndex) add(m *Metrics) {
+	t, exists := d[m.TargetID]
+	if !exists {
+		t = &discoveryTarget{
+			keys:       make(map[string]int64),
+			dimensions: make(map[string]map[string]int64),
+		}
+		d[m.TargetID] = t
+	}
+
+	t.series++
+	t.keys[m.Key]++
+	for name, value := range m.Metadata {
+		values, exists := t.dimensions[name]
+		if !exists {
+			values = make(map[string]int64)
+			t.dimensions[name] = values
+		}
+		values[value]++
+	}
+}
+
+func (t *discoveryTarget) toProto(targetID string) *proto.DiscoveryTarget {
+	target := &proto.DiscoveryTarget{
+		TargetId:    targetID,
+		SeriesCount: t.series,
+		Keys:        make([]*proto.DiscoveryKey, 0, len(t.keys)),
+		Dimensions:  make([]*proto.DiscoveryDimension, 0, len(t.dimensions)),
+	}
+	for key, count := range t.keys {
+		target.Keys = append(target.Keys, &proto.DiscoveryKey{Key: key, SeriesCount: count})
+	}
+	sort.Slice(target.Keys, func(i, j int) bool { return target.Keys[i].Key < target.Keys[j].Key })
+
+	for name, values := range t.dimensions {
+		dimension := &proto.DiscoveryDimension{
+			Name:   name,
+			Values: make([]*proto.DiscoveryValue, 0, len(values)),
+		}
+		for value, count := range values {
+			dimension.Values = append(dimension.Values, &proto.DiscoveryValue{Value: value, SeriesCount: count})
+		}
+		sort.Slice(dimension.Values, func(i, j int) bool { return dimension.Values[i].Value < dimension.Values[j].Value })
+		target.Dimensions = append(target.Dimensions, dimension)
+	}
+	sort.Slice(target.Dimensions, func(i, j int) bool { return target.Dimensions[i].Name < target.Dimensions[j].Name })
+	return target
+}
+
+// Discovery returns the targets, keys and metadata dimensions of all series,
+// or of a single target if targetID is set
+func (c *MetricsCalculator) Discovery(targetID string) *proto.DiscoveryIndex {
+	c.metricsMu.RLock()
+	defer c.metricsMu.RUnlock()
+
+	index := &proto.DiscoveryIndex{}
+	for id, t := range c.discovery {
+		if targetID == "" || id == targetID {
+			index.Targets = append(index.Targets, t.toProto(id))
+		}
+	}
+	sort.Slice(index.Targets, func(i, j int) bool { return index.Targets[i].TargetId < index.Targets[j].TargetId })
+	return index
+}
@@ -0,0 +1,58 @@
+package calculator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscovery(t *testing.T) {
+	calc := NewMetricsCalculator()
+	stop := runCalculator(t, calc)
+	defer stop()
+
+	base := time.Now()
+	for _, e := range []struct {
+		target, key, region string
+	}{
+		{"api", "login", "us"},
+		{"api", "login", "eu"},
+		{"api", "search", "us"},
+		{"api", "search", "us"}, // Same series again
+		{"db", "query", "us"},
+	} {
+		event := createTestEvent(e.target, e.key, map[string]string{"region": e.region})
+		event.ServerTimestamp = base.UnixNano()
+		require.NoError(t, calc.ProcessEvent(event))
+	}
+	time.Sleep(shortWait)
+
+	index := calc.Discovery("")
+	require.Len(t, index.Targets, 2)
+	assert.Equal(t, "db", index.Targets[1].TargetId)
+
+	api := index.Targets[0]
+	assert.Equal(t, "api", api.TargetId)
+	assert.Equal(t, int64(3), api.SeriesCount)
+	require.Len(t, api.Keys, 2)
+	assert.Equal(t, "login", api.Keys[0].Key)
+	assert.Equal(t, int64(2), api.Keys[0].SeriesCount)
+	assert.Equal(t, "search", api.Keys[1].Key)
+	assert.Equal(t, int64(1), api.Keys[1].SeriesCount)
+
+	require.Len(t, api.Dimensions, 1)
+	region := api.Dimensions[0]
+	assert.Equal(t, "region", region.Name)
+	require.Len(t, region.Values, 2)
+	assert.Equal(t, "eu", region.Values[0].Value)
+	assert.Equal(t, int64(1), region.Values[0].SeriesCount)
+	assert.Equal(t, "us", region.Values[1].Value)
+	assert.Equal(t, int64(2), region.Values[1].SeriesCount)
+
+	filtered := calc.Discovery("db")
+	require.Len(t, filtered.Targets, 1)
+	assert.Equal(t, "db", filtered.Targets[0].TargetId)
+	assert.Empty(t, calc.Discovery("missing").Targets)
+}
@@ -0,0 +1,45 @@
+package calculator
+
+import (
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+const (
+	// MaxOutlierExemplars is the number of recent above-P90 exemplars kept
+	// per series
+	MaxOutlierExemplars = 10
+)
+
+// newExemplar records the event that closed an interval
+func newExemplar(event *proto.Event, intervalMs float64) *proto.Exemplar {
+	return &proto.Exemplar{
+		Timestamp: event.ServerTimestamp,
+		Value:     intervalMs,
+		Metadata:  event.Metadata,
+		TraceId:   event.TraceId,
+		EventId:   event.EventId,
+	}
+}
+
+// recordExemplars keeps the event behind the current max and the most
+// recent events above the P90; callers hold mu
+func (m *Metrics) recordExemplars(event *proto.Event, intervalMs float64) {
+	if m.maxExemplar == nil || intervalMs >= m.Max() {
+		m.maxExemplar = newExemplar(event, intervalMs)
+	}
+
+	if intervalMs > m.P90() {
+		if len(m.outlierExemplars) == MaxOutlierExemplars {
+			m.outlierExemplars = append(m.outlierExemplars[:0], m.outlierExemplars[1:]...)
+		}
+		m.outlierExemplars = append(m.outlierExemplars, newExemplar(event, intervalMs))
+	}
+}
+
+// Exemplars returns the exemplar of the current max and the recent outlier
+// exemplars, oldest first
+func (m *Metrics) Exemplars() (*proto.Exemplar, []*proto.Exemplar) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.maxExemplar, append([]*proto.Exemplar(nil), m.outlierExemplars...)
+}
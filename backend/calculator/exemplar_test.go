@@ -0,0 +1,64 @@
+package calculator
+
+import (
+	"container/ring"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExemplars(t *testing.T) {
+	m := &Metrics{Samples: ring.New(MaxSamples)}
+
+	// Steady 100ms intervals with a single 4s stall
+	base := time.Now()
+	var offset time.Duration
+	for i := range 20 {
+		if i == 15 {
+			offset += 4 * time.Second
+		} else {
+			offset += 100 * time.Millisecond
+		}
+		m.Update(&proto.Event{
+			TargetId:        testTargetID,
+			Key:             testKey,
+			ServerTimestamp: base.Add(offset).UnixNano(),
+			Metadata:        map[string]string{"tier": testTier},
+			TraceId:         fmt.Sprintf("trace-%d", i),
+		})
+	}
+
+	maxExemplar, outliers := m.Exemplars()
+	require.NotNil(t, maxExemplar)
+	assert.Equal(t, "trace-15", maxExemplar.TraceId)
+	assert.InDelta(t, 4000.0, maxExemplar.Value, 0.001)
+	assert.Equal(t, base.Add(offset-4*100*time.Millisecond).UnixNano(), maxExemplar.Timestamp)
+	assert.Equal(t, testTier, maxExemplar.Metadata["tier"])
+
+	require.NotEmpty(t, outliers)
+	assert.Equal(t, "trace-15", outliers[len(outliers)-1].TraceId)
+	assert.LessOrEqual(t, len(outliers), MaxOutlierExemplars)
+}
+
+func TestOutlierExemplarsBounded(t *testing.T) {
+	m := &Metrics{Samples: ring.New(MaxSamples)}
+
+	// Every interval grows, so each one lands above the P90
+	base := time.Now()
+	var offset time.Duration
+	for i := range 3 * MaxOutlierExemplars {
+		offset += time.Duration(i+1) * time.Millisecond
+		m.Update(&proto.Event{
+			ServerTimestamp: base.Add(offset).UnixNano(),
+			TraceId:         fmt.Sprintf("trace-%d", i),
+		})
+	}
+
+	_, outliers := m.Exemplars()
+	require.Len(t, outliers, MaxOutlierExemplars)
+	assert.Equal(t, fmt.Sprintf("trace-%d", 3*MaxOutlierExemplars-1), outliers[len(outliers)-1].TraceId)
+}
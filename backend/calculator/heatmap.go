@@ -0,0 +1,152 @@
+package calculator
+
+import (
+	"sort"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const (
+	// DefaultHeatmapColumn is the width of a heatmap column when
+	// Config.HeatmapColumn is not set
+	DefaultHeatmapColumn = 10 * time.Second
+
+	// DefaultHeatmapRetention is how much heatmap history is kept per series
+	// when Config.HeatmapRetention is not set
+	DefaultHeatmapRetention = 1 * time.Hour
+)
+
+// DefaultHeatmapBuckets are the latency bucket upper bounds in milliseconds
+// used when Config.HeatmapBuckets is empty. Intervals above the last bound
+// land in an extra overflow bucket.
+var DefaultHeatmapBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000}
+
+// seriesHeatmap accumulates latency-bucket counts into fixed time columns.
+// Closed columns are kept for the retention window and queued for
+// subscribers until drained.
+type seriesHeatmap struct {
+	width      int64     // Column width in nanoseconds
+	bounds     []float64 // Bucket upper bounds in milliseconds, shared
+	maxColumns int
+
+	current *proto.HeatmapFrame
+	closed  []*proto.HeatmapFrame // Oldest first
+	pending []*proto.HeatmapFrame // Closed but not yet sent to subscribers
+}
+
+func (c *MetricsCalculator) newSeriesHeatmap() *seriesHeatmap {
+	return &seriesHeatmap{
+		width:      int64(c.config.HeatmapColumn),
+		bounds:     c.config.HeatmapBuckets,
+		maxColumns: int(c.config.HeatmapRetention / c.config.HeatmapColumn),
+	}
+}
+
+// record counts an interval in the column containing timestamp, weighted by
+// the sample rate of its event. Moving past the current column closes it;
+// intervals older than the current column are dropped rather than reopening
+// a closed one.
+func (h *seriesHeatmap) record(m *Metrics, timestamp int64, intervalMs, weight float64) {
+	start := timestamp - timestamp%h.width
+	if h.current != nil && start < h.current.Start {
+		return
+	}
+	if h.current == nil || start > h.current.Start {
+		h.close()
+		h.current = &proto.HeatmapFrame{
+			SeriesId: m.id,
+			TargetId: m.TargetID,
+			Key:      m.Key,
+			Metadata: m.Metadata,
+			Start:    start,
+			Width:    h.width,
+			Bounds:   h.bounds,
+			Counts:   make([]float64, len(h.bounds)+1),
+		}
+	}
+
+	// The first bound at or above the interval, or the overflow bucket
+	h.current.Counts[sort.SearchFloat64s(h.bounds, intervalMs)] += weight
+}
+
+func (h *seriesHeatmap) close() {
+	if h.current == nil {
+		return
+	}
+	h.closed = append(h.closed, h.current)
+	if len(h.closed) > h.maxColumns {
+		h.closed = append(h.closed[:0], h.closed[len(h.closed)-h.maxColumns:]...)
+	}
+	h.pending = append(h.pending, h.current)
+	h.current = nil
+}
+
+// frames returns the retained columns including the open one, oldest first
+func (h *seriesHeatmap) frames() []*proto.HeatmapFrame {
+	frames := append([]*proto.HeatmapFrame(nil), h.closed...)
+	if h.current != nil {
+		// Copy the open column so later intervals don't race with the caller
+		frames = append(frames, protobuf.Clone(h.current).(*proto.HeatmapFrame))
+	}
+	return frames
+}
+
+// drainHeatmapFrames returns the columns closed since the last call
+func (m *Metrics) drainHeatmapFrames() []*proto.HeatmapFrame {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.heatmap == nil || len(m.heatmap.pending) == 0 {
+		return nil
+	}
+	pending := m.heatmap.pending
+	m.heatmap.pending = nil
+	return pending
+}
+
+// Heatmap returns the retained heatmap columns of a series, oldest first.
+// The last column is still open and may grow.
+func (c *MetricsCalculator) Heatmap(seriesID string) ([]*proto.HeatmapFrame, error) {
+	m, exists := c.metric(seriesID)
+	if !exists {
+		return nil, ErrSeriesNotFound
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.heatmap == nil {
+		return nil, nil
+	}
+	return m.heatmap.frames(), nil
+}
+
+// SubscribeHeatmaps returns a channel receiving every heatmap column as it
+// closes
+func (c *MetricsCalculator) SubscribeHeatmaps() chan *proto.HeatmapFrame {
+	ch := make(chan *proto.HeatmapFrame, 100)
+	c.subscribersMu.Lock()
+	c.heatmapSubscribers[ch] = struct{}{}
+	c.subscribersMu.Unlock()
+	return ch
+}
+
+func (c *MetricsCalculator) UnsubscribeHeatmaps(ch chan *proto.HeatmapFrame) {
+	c.subscribersMu.Lock()
+	defer c.subscribersMu.Unlock()
+	delete(c.heatmapSubscribers, ch)
+	close(ch)
+}
+
+func (c *MetricsCalculator) notifyHeatmapSubscribers(frame *proto.HeatmapFrame) {
+	c.subscribersMu.RLock()
+	defer c.subscribersMu.RUnlock()
+
+	for ch := range c.heatmapSubscribers {
+		select {
+		case ch <- frame:
+		default:
+			// Drop frame if subscriber's channel is full to prevent blocking
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package calculator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeatmapColumns(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{
+		HeatmapColumn:    10 * time.Second,
+		HeatmapBuckets:   []float64{100, 1000},
+		HeatmapRetention: 20 * time.Second,
+	})
+	m := calc.createMetric(testTargetID+":"+testKey, createTestEvent(testTargetID, testKey, nil))
+
+	base := time.Now().Truncate(time.Minute)
+	record := func(offset time.Duration, intervalMs float64) {
+		m.heatmap.record(m, base.Add(offset).UnixNano(), intervalMs, 1)
+	}
+	record(1*time.Second, 50)
+	record(2*time.Second, 100)
+	record(3*time.Second, 500)
+	record(4*time.Second, 5000)
+	assert.Empty(t, m.drainHeatmapFrames(), "The first column is still open")
+
+	// Moving on closes the column and queues it for subscribers
+	record(12*time.Second, 50)
+	pending := m.drainHeatmapFrames()
+	require.Len(t, pending, 1)
+	assert.Equal(t, base.UnixNano(), pending[0].Start)
+	assert.Equal(t, int64(10*time.Second), pending[0].Width)
+	assert.Equal(t, []float64{2, 1, 1}, pending[0].Counts)
+	assert.Empty(t, m.drainHeatmapFrames(), "Frames are only drained once")
+
+	// Late intervals for closed columns are dropped
+	record(5*time.Second, 50)
+
+	// Empty columns are skipped and retention trims the oldest ones
+	record(45*time.Second, 50)
+	record(55*time.Second, 50)
+	frames, err := calc.Heatmap(m.ID())
+	require.NoError(t, err)
+	require.Len(t, frames, 3)
+	assert.Equal(t, base.Add(10*time.Second).UnixNano(), frames[0].Start)
+	assert.Equal(t, []float64{1, 0, 0}, frames[0].Counts)
+	assert.Equal(t, base.Add(50*time.Second).UnixNano(), frames[2].Start, "The open column comes last")
+
+	_, err = calc.Heatmap("unknown")
+	assert.ErrorIs(t, err, ErrSeriesNotFound)
+}
+
+func TestHeatmapSubscribers(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{HeatmapColumn: time.Second})
+	frames := calc.SubscribeHeatmaps()
+	stop := runCalculator(t, calc)
+	defer stop()
+
+	base := time.Now().Truncate(time.Second)
+	for i := range 3 {
+		event := createTestEvent(testTargetID, testKey, nil)
+		event.ServerTimestamp = base.Add(time.Duration(i) * time.Second).UnixNano()
+		require.NoError(t, calc.ProcessEvent(event))
+	}
+
+	select {
+	case frame := <-frames:
+		assert.Equal(t, testTargetID, frame.TargetId)
+		assert.Equal(t, base.Add(time.Second).UnixNano(), frame.Start)
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for heatmap frame")
+	}
+}
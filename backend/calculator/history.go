@@ -0,0 +1,344 @@
+package calculator
+
+import (
+	"sort"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+// HistoryResolution is one level of downsampled history: buckets of Step
+// width that are kept for Retention.
+type HistoryResolution struct {
+	Step      time.Duration
+	Retention time.Duration
+}
+
+// DefaultHistoryResolutions are used when Config.HistoryResolutions is empty.
+// A bucket takes roughly 100 bytes plus its sketch bins, so a series with an
+// event every second holds some 350KB in its 3600 one-second buckets alone;
+// drop that level when tracking many thousands of series.
+var DefaultHistoryResolutions = []HistoryResolution{
+	{Step: time.Second, Retention: time.Hour},
+	{Step: time.Minute, Retention: 24 * time.Hour},
+	{Step: time.Hour, Retention: 30 * 24 * time.Hour},
+}
+
+// DefaultHistorySnapshotStep is used when Config.HistorySnapshotStep is not
+// set. The one-second level is relearned within its hour of retention,
+// while checkpointing it would journal a bucket per second of every series.
+const DefaultHistorySnapshotStep = time.Minute
+
+type historyBucket struct {
+	start int64 // Unix nanoseconds
+	count int64
+	sum   float64
+	min   float64
+	max   float64
+	// sketch holds the distribution of the bucket's own intervals, so the
+	// P90 of any range of buckets can be computed when it is queried
+	sketch quantileSketch
+}
+
+func (b *historyBucket) add(intervalMs float64) {
+	if b.count == 0 || intervalMs < b.min {
+		b.min = intervalMs
+	}
+	if b.count == 0 || intervalMs > b.max {
+		b.max = intervalMs
+	}
+	b.count++
+	b.sum += intervalMs
+	b.sketch.add(intervalMs)
+}
+
+// merge folds a later bucket into b
+func (b *historyBucket) merge(o *historyBucket) {
+	if o.count == 0 {
+		return
+	}
+	if b.count == 0 || o.min < b.min {
+		b.min = o.min
+	}
+	if b.count == 0 || o.max > b.max {
+		b.max = o.max
+	}
+	b.count += o.count
+	b.sum += o.sum
+	b.sketch.merge(&o.sketch)
+}
+
+func (b *historyBucket) toProto() *proto.HistoryBucket {
+	bucket := &proto.HistoryBucket{
+		Start: b.start,
+		Count: b.count,
+		Min:   b.min,
+		Max:   b.max,
+	}
+	if b.count > 0 {
+		bucket.Avg = b.sum / float64(b.count)
+		// The sketch is only accurate to a percent; the extremes are exact
+		bucket.P90 = min(max(b.sketch.quantile(P90Percentile), b.min), b.max)
+	}
+	return bucket
+}
+
+// historyLevel holds the buckets of a single resolution, oldest first, in a
+// ring that grows up to the number of buckets the retention spans. Expired
+// buckets are dropped from the front without moving the others.
+type historyLevel struct {
+	step      int64
+	retention int64
+	ring      []historyBucket
+	head      int // Index of the oldest bucket in ring
+	n         int // Number of buckets
+
+	// changed is set when a bucket starting at or after changedFrom was
+	// written since the levels were last journaled
+	changed     bool
+	changedFrom int64
+}
+
+// len returns the number of buckets
+func (l *historyLevel) len() int {
+	return l.n
+}
+
+// at returns the i-th oldest bucket
+func (l *historyLevel) at(i int) *historyBucket {
+	return &l.ring[(l.head+i)%len(l.ring)]
+}
+
+// capacity is the most buckets the retention window can hold
+func (l *historyLevel) capacity() int {
+	return max(int((l.retention+l.step-1)/l.step), 1)
+}
+
+func (l *historyLevel) record(timestamp int64, intervalMs float64) {
+	start := timestamp - timestamp%l.step
+	b := l.bucket(start)
+	if b == nil {
+		return
+	}
+	b.add(intervalMs)
+	if !l.changed || start < l.changedFrom {
+		l.changed, l.changedFrom = true, start
+	}
+}
+
+// bucket returns the bucket starting at start, adding it if needed. It
+// returns nil if the bucket is already out of the retention window.
+func (l *historyLevel) bucket(start int64) *historyBucket {
+	// Events normally arrive in order, so the bucket is almost always the last one
+	i := l.n - 1
+	for i >= 0 && l.at(i).start > start {
+		i--
+	}
+	if i < 0 || l.at(i).start != start {
+		if l.n > 0 && start <= l.at(l.n-1).start-l.retention {
+			return nil
+		}
+		i = l.insert(i+1, start)
+	}
+	return l.at(i)
+}
+
+// insert adds an empty bucket at position i, after dropping the buckets a
+// new bucket pushes out of the retention window. It returns the position
+// of the new bucket.
+func (l *historyLevel) insert(i int, start int64) int {
+	if i == l.n {
+		// Drop buckets that fell out of the retention window
+		for l.n > 0 && l.at(0).start <= start-l.retention {
+			*l.at(0) = historyBucket{}
+			l.head = (l.head + 1) % len(l.ring)
+			l.n--
+			i--
+		}
+	}
+	if l.n == len(l.ring) {
+		l.grow()
+	}
+
+	// Shift the newer buckets up; this only happens for late events
+	for j := l.n; j > i; j-- {
+		*l.at(j) = *l.at(j - 1)
+	}
+	*l.at(i) = historyBucket{start: start}
+	l.n++
+	return i
+}
+
+// grow doubles the ring, up to its capacity, keeping the bucket order
+func (l *historyLevel) grow() {
+	ring := make([]historyBucket, min(max(2*len(l.ring), 8), l.capacity()))
+	for j := range l.n {
+		ring[j] = *l.at(j)
+	}
+	l.ring, l.head = ring, 0
+}
+
+// seriesHistory keeps the downsampled history of a series at every
+// configured resolution. Each level is written directly rather than rolled
+// up from the finer one so that they all survive their own retention.
+type seriesHistory struct {
+	levels []*historyLevel
+}
+
+func newSeriesHistory(resolutions []HistoryResolution) *seriesHistory {
+	h := &seriesHistory{levels: make([]*historyLevel, 0, len(resolutions))}
+	for _, r := range resolutions {
+		h.levels = append(h.levels, &historyLevel{
+			step:      int64(r.Step),
+			retention: int64(r.Retention),
+		})
+	}
+	sort.Slice(h.levels, func(i, j int) bool { return h.levels[i].step < h.levels[j].step })
+	return h
+}
+
+func (h *seriesHistory) record(timestamp int64, intervalMs float64) {
+	for _, l := range h.levels {
+		l.record(timestamp, intervalMs)
+	}
+}
+
+// query returns the buckets in [from, to) merged into buckets of the given
+// step, along with the step actually used.
+func (h *seriesHistory) query(from, to, step int64) (int64, []*proto.HistoryBucket) {
+	if len(h.levels) == 0 {
+		return step, nil
+	}
+
+	level := h.level(from, step)
+	if step < level.step {
+		step = level.step
+	}
+
+	var buckets []*proto.HistoryBucket
+	var current *historyBucket
+	for i := range level.len() {
+		b := level.at(i)
+		if b.start < from-from%level.step || b.start >= to {
+			continue
+		}
+		start := b.start - b.start%step
+		if current == nil || current.start != start {
+			if current != nil {
+				buckets = append(buckets, current.toProto())
+			}
+			current = &historyBucket{start: start}
+		}
+		current.merge(b)
+	}
+	if current != nil {
+		buckets = append(buckets, current.toProto())
+	}
+	return step, buckets
+}
+
+// level picks the resolution a query is answered from. Levels are sorted
+// finest first.
+func (h *seriesHistory) level(from, step int64) *historyLevel {
+	if step > 0 {
+		level := h.levels[0]
+		for _, l := range h.levels {
+			if l.step <= step {
+				level = l
+			}
+		}
+		return level
+	}
+
+	for _, l := range h.levels {
+		if l.len() > 0 && l.at(0).start <= from {
+			return l
+		}
+	}
+	return h.levels[len(h.levels)-1]
+}
+
+// changes captures the levels with a step of at least minStep for the
+// history journal: every bucket when full is set, otherwise only those
+// written since the previous call
+func (h *seriesHistory) changes(minStep int64, full bool) []*proto.HistoryLevel {
+	var levels []*proto.HistoryLevel
+	for _, l := range h.levels {
+		if l.step < minStep || (!full && !l.changed) {
+			continue
+		}
+		first := 0
+		if !full {
+			// Changes are almost always to the newest buckets
+			first = l.len()
+			for first > 0 && l.at(first-1).start >= l.changedFrom {
+				first--
+			}
+		}
+		level := &proto.HistoryLevel{Step: l.step}
+		for i := first; i < l.len(); i++ {
+			b := l.at(i)
+			bucket := b.toProto()
+			bucket.Sketch = b.sketch.toProto()
+			level.Buckets = append(level.Buckets, bucket)
+		}
+		l.changed = false
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+// restore loads persisted buckets into the levels with a matching step,
+// replacing any bucket with the same start. Levels that are no longer
+// configured are dropped.
+func (h *seriesHistory) restore(levels []*proto.HistoryLevel) {
+	for _, saved := range levels {
+		for _, l := range h.levels {
+			if l.step != saved.Step {
+				continue
+			}
+			for _, b := range saved.Buckets {
+				bucket := l.bucket(b.Start)
+				if bucket == nil {
+					continue
+				}
+				*bucket = historyBucket{
+					start: b.Start,
+					count: b.Count,
+					sum:   b.Avg * float64(b.Count),
+					min:   b.Min,
+					max:   b.Max,
+				}
+				if b.Sketch != nil {
+					bucket.sketch = sketchFromProto(b.Sketch)
+				} else if b.Count > 0 {
+					// Snapshots from before sketches only have the P90
+					bucket.sketch.addCount(b.P90, b.Count)
+				}
+			}
+		}
+	}
+}
+
+// History returns the downsampled history of a series between from and to,
+// bucketed by step. A zero step uses the finest resolution that covers the
+// range.
+func (c *MetricsCalculator) History(seriesID string, from, to time.Time, step time.Duration) (*proto.SeriesHistory, error) {
+	m, exists := c.metric(seriesID)
+	if !exists {
+		return nil, ErrSeriesNotFound
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	fromNs, toNs := from.UnixNano(), to.UnixNano()
+	actualStep, buckets := m.history.query(fromNs, toNs, int64(step))
+	return &proto.SeriesHistory{
+		SeriesId: seriesID,
+		From:     fromNs,
+		To:       toNs,
+		Step:     actualStep,
+		Buckets:  buckets,
+	}, nil
+}
@@ -0,0 +1,159 @@
+package calculator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryBuckets(t *testing.T) {
+	h := newSeriesHistory([]HistoryResolution{
+		{Step: time.Minute, Retention: time.Hour},
+		{Step: time.Second, Retention: 10 * time.Second},
+	})
+
+	base := time.Date(2025, 1, 1, 3, 0, 0, 0, time.UTC)
+	for i := range 30 {
+		ts := base.Add(time.Duration(i) * time.Second).UnixNano()
+		h.record(ts, float64(i))
+	}
+
+	// Levels are sorted finest first regardless of configuration order
+	require.Len(t, h.levels, 2)
+	assert.Equal(t, int64(time.Second), h.levels[0].step)
+
+	// The 1s level only keeps its retention window
+	assert.Equal(t, 10, h.levels[0].len())
+	assert.Equal(t, base.Add(20*time.Second).UnixNano(), h.levels[0].at(0).start)
+
+	// The 1m level still holds everything in a single bucket
+	step, buckets := h.query(base.UnixNano(), base.Add(time.Hour).UnixNano(), int64(time.Minute))
+	assert.Equal(t, int64(time.Minute), step)
+	require.Len(t, buckets, 1)
+	assert.Equal(t, int64(30), buckets[0].Count)
+	assert.Equal(t, 0.0, buckets[0].Min)
+	assert.Equal(t, 29.0, buckets[0].Max)
+	assert.Equal(t, 14.5, buckets[0].Avg)
+	assert.InEpsilon(t, 26.0, buckets[0].P90, SketchAccuracy)
+
+	// A coarser step than any level is merged from the coarsest level
+	step, buckets = h.query(base.UnixNano(), base.Add(time.Hour).UnixNano(), int64(2*time.Minute))
+	assert.Equal(t, int64(2*time.Minute), step)
+	require.Len(t, buckets, 1)
+
+	// Recent ranges without a step are answered by the finest level
+	step, buckets = h.query(base.Add(25*time.Second).UnixNano(), base.Add(time.Hour).UnixNano(), 0)
+	assert.Equal(t, int64(time.Second), step)
+	assert.Len(t, buckets, 5)
+
+	// Older ranges fall back to a level that still reaches back far enough
+	step, _ = h.query(base.UnixNano(), base.Add(time.Hour).UnixNano(), 0)
+	assert.Equal(t, int64(time.Minute), step)
+}
+
+func TestHistoryOutOfOrder(t *testing.T) {
+	h := newSeriesHistory([]HistoryResolution{{Step: time.Second, Retention: time.Hour}})
+
+	base := time.Date(2025, 1, 1, 3, 0, 0, 0, time.UTC)
+	h.record(base.Add(2*time.Second).UnixNano(), 2)
+	h.record(base.UnixNano(), 1)
+	h.record(base.Add(1*time.Second).UnixNano(), 3)
+
+	_, buckets := h.query(base.UnixNano(), base.Add(time.Minute).UnixNano(), 0)
+	require.Len(t, buckets, 3)
+	for i, b := range buckets {
+		assert.Equal(t, base.Add(time.Duration(i)*time.Second).UnixNano(), b.Start)
+	}
+}
+
+func TestHistoryBucketP90(t *testing.T) {
+	h := newSeriesHistory([]HistoryResolution{{Step: time.Hour, Retention: 24 * time.Hour}})
+
+	// A slow series: one interval every 10s, around 10s until 03:00 and
+	// around 100ms after
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 3 * 360 {
+		h.record(base.Add(time.Duration(i)*10*time.Second).UnixNano(), 10000+float64(i%10))
+	}
+	for i := range 360 {
+		h.record(base.Add(3*time.Hour+time.Duration(i)*10*time.Second).UnixNano(), 100+float64(i%10))
+	}
+
+	// The P90 of each bucket only reflects its own intervals
+	_, buckets := h.query(base.UnixNano(), base.Add(4*time.Hour).UnixNano(), int64(time.Hour))
+	require.Len(t, buckets, 4)
+	assert.InEpsilon(t, 10008.0, buckets[2].P90, SketchAccuracy)
+	assert.InEpsilon(t, 108.0, buckets[3].P90, SketchAccuracy)
+
+	// Merged buckets combine their distributions
+	_, buckets = h.query(base.UnixNano(), base.Add(4*time.Hour).UnixNano(), int64(4*time.Hour))
+	require.Len(t, buckets, 1)
+	assert.InEpsilon(t, 10009.0, buckets[0].P90, SketchAccuracy)
+	_, buckets = h.query(base.Add(2*time.Hour).UnixNano(), base.Add(4*time.Hour).UnixNano(), int64(2*time.Hour))
+	require.Len(t, buckets, 1)
+	assert.InEpsilon(t, 10008.0, buckets[0].P90, SketchAccuracy)
+}
+
+func TestHistoryRing(t *testing.T) {
+	h := newSeriesHistory([]HistoryResolution{{Step: time.Second, Retention: 10 * time.Second}})
+	level := h.levels[0]
+
+	// The ring wraps around many times without growing past the retention
+	base := time.Date(2025, 1, 1, 3, 0, 0, 0, time.UTC)
+	for i := range 95 {
+		h.record(base.Add(time.Duration(i)*time.Second).UnixNano(), float64(i))
+	}
+	assert.Len(t, level.ring, 10)
+	require.Equal(t, 10, level.len())
+	for i := range level.len() {
+		assert.Equal(t, base.Add(time.Duration(85+i)*time.Second).UnixNano(), level.at(i).start)
+	}
+
+	// Late events land in order across the wrap point; expired ones are dropped
+	h.record(base.Add(90*time.Second+500*time.Millisecond).UnixNano(), 1)
+	h.record(base.Add(80*time.Second).UnixNano(), 1)
+	assert.Equal(t, int64(2), level.at(5).count)
+	assert.Equal(t, 10, level.len())
+
+	// A gap expires everything older than the window
+	h.record(base.Add(100*time.Second).UnixNano(), 1)
+	require.Equal(t, 5, level.len())
+	assert.Equal(t, base.Add(91*time.Second).UnixNano(), level.at(0).start)
+	assert.Equal(t, base.Add(100*time.Second).UnixNano(), level.at(4).start)
+
+	// Buckets with gaps between them leave space for late ones
+	h.record(base.Add(97*time.Second).UnixNano(), 1)
+	h.record(base.Add(98*time.Second).UnixNano(), 1)
+	require.Equal(t, 7, level.len())
+	for i := 1; i < level.len(); i++ {
+		assert.Less(t, level.at(i-1).start, level.at(i).start)
+	}
+}
+
+func TestCalculatorHistory(t *testing.T) {
+	calc := NewMetricsCalculator()
+	stop := runCalculator(t, calc)
+	defer stop()
+
+	base := time.Now().Truncate(time.Minute)
+	for i := range 5 {
+		event := createTestEvent(testTargetID, testKey, nil)
+		event.ServerTimestamp = base.Add(time.Duration(i) * time.Second).UnixNano()
+		assert.NoError(t, calc.ProcessEvent(event))
+	}
+	time.Sleep(shortWait)
+
+	all := calc.GetAllMetrics()
+	require.Len(t, all, 1)
+
+	history, err := calc.History(all[0].SeriesId, base, base.Add(time.Minute), time.Minute)
+	require.NoError(t, err)
+	require.Len(t, history.Buckets, 1)
+	assert.Equal(t, int64(4), history.Buckets[0].Count)
+	assert.Equal(t, 1000.0, history.Buckets[0].Avg)
+
+	_, err = calc.History("unknown", base, base.Add(time.Minute), 0)
+	assert.ErrorIs(t, err, ErrSeriesNotFound)
+}
@@ -0,0 +1,162 @@
+package calculator
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+const (
+	// historyJournalSuffix is appended to Config.SnapshotPath to name the
+	// history journal
+	historyJournalSuffix = ".history"
+
+	// historyJournalSlack is how far the journal may outgrow twice its
+	// compacted size before it is rewritten
+	historyJournalSlack = 1 << 20
+)
+
+// historyJournal tracks the history journal kept next to the snapshot. Each
+// checkpoint appends the buckets changed since the previous one, so the
+// minute level costs a bucket or two per series rather than a day of them.
+// Once the journal has grown past twice its compacted size it is rewritten
+// with only the live buckets. Guarded by MetricsCalculator.snapshotMu.
+type historyJournal struct {
+	size      int64 // Bytes written to the file
+	compacted int64 // Size of the file when it was last rewritten
+	// rewrite is set when the file doesn't hold every live bucket, such as
+	// before the first checkpoint or after a failed append
+	rewrite bool
+}
+
+func (c *MetricsCalculator) historyJournalPath() string {
+	return c.config.SnapshotPath + historyJournalSuffix
+}
+
+// saveHistory checkpoints the history of the given series to the journal
+func (c *MetricsCalculator) saveHistory(series []*Metrics) error {
+	j := &c.historyJournal
+	if j.rewrite || j.size > 2*j.compacted+historyJournalSlack {
+		return c.rewriteHistory(series)
+	}
+
+	file, err := os.OpenFile(c.historyJournalPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		j.rewrite = true
+		return fmt.Errorf("opening history journal: %w", err)
+	}
+	n, err := writeHistory(file, series, int64(c.config.HistorySnapshotStep), false)
+	j.size += n
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// The changes are lost from memory too, so start over next time
+		j.rewrite = true
+		return fmt.Errorf("appending to history journal: %w", err)
+	}
+	return nil
+}
+
+// rewriteHistory replaces the journal with every live bucket. Like the
+// snapshot, the file is replaced atomically.
+func (c *MetricsCalculator) rewriteHistory(series []*Metrics) error {
+	j := &c.historyJournal
+	path := c.historyJournalPath()
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating history journal: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	// The buckets are marked unchanged as they are written, so a failure
+	// from here on has to be rewritten again
+	j.rewrite = true
+	n, err := writeHistory(tmp, series, int64(c.config.HistorySnapshotStep), true)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing history journal: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	*j = historyJournal{size: n, compacted: n}
+	return nil
+}
+
+// writeHistory writes a journal record for each series whose persisted
+// levels changed, or for every series when full is set
+func writeHistory(w io.Writer, series []*Metrics, minStep int64, full bool) (int64, error) {
+	buffered := bufio.NewWriter(w)
+	var written int64
+	for _, m := range series {
+		levels := m.historyChanges(minStep, full)
+		if len(levels) == 0 {
+			continue
+		}
+		n, err := protodelim.MarshalTo(buffered, &proto.HistoryRecord{SeriesId: m.id, Levels: levels})
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	err := buffered.Flush()
+	return written, err
+}
+
+// historyChanges returns the persisted history levels of the series for the
+// journal, see seriesHistory.changes
+func (m *Metrics) historyChanges(minStep int64, full bool) []*proto.HistoryLevel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.history == nil {
+		return nil
+	}
+	return m.history.changes(minStep, full)
+}
+
+// restoreHistory replays the journal into the restored series. Called with
+// metricsMu held. Records of series missing from the snapshot are skipped.
+func (c *MetricsCalculator) restoreHistory() error {
+	j := &c.historyJournal
+	file, err := os.Open(c.historyJournalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading history journal: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		var record proto.HistoryRecord
+		err := protodelim.UnmarshalFrom(reader, &record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// Most likely a checkpoint cut short; keep what was read
+			return fmt.Errorf("reading history journal: %w", err)
+		}
+		if m, exists := c.metrics[record.SeriesId]; exists && m.history != nil {
+			m.history.restore(record.Levels)
+		}
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("reading history journal: %w", err)
+	}
+	// Appending is safe now that every live bucket is known to be in the file
+	*j = historyJournal{size: info.Size(), compacted: info.Size()}
+	return nil
+}
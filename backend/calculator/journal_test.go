@@ -0,0 +1,121 @@
+package calculator
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+// readHistoryJournal reads every record of a history journal
+func readHistoryJournal(t *testing.T, path string) []*proto.HistoryRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var records []*proto.HistoryRecord
+	reader := bufio.NewReader(file)
+	for {
+		var record proto.HistoryRecord
+		err := protodelim.UnmarshalFrom(reader, &record)
+		if errors.Is(err, io.EOF) {
+			return records
+		}
+		require.NoError(t, err)
+		records = append(records, &record)
+	}
+}
+
+func TestHistoryJournalAppendsChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.snapshot")
+	config := Config{SnapshotPath: path}
+	calc := NewMetricsCalculatorWithConfig(config)
+	stop := runCalculator(t, calc)
+
+	base := time.Now().Truncate(time.Hour)
+	sendAt(t, calc, testTargetID, base, 0, 10*time.Second, 20*time.Second)
+	time.Sleep(shortWait)
+
+	// The first checkpoint writes the whole history of the minute and hour levels
+	require.NoError(t, calc.saveSnapshot())
+	records := readHistoryJournal(t, path+historyJournalSuffix)
+	require.Len(t, records, 1)
+	require.Len(t, records[0].Levels, 2)
+	assert.Equal(t, int64(time.Minute), records[0].Levels[0].Step)
+	assert.Equal(t, int64(time.Hour), records[0].Levels[1].Step)
+
+	// Later ones only append the buckets that changed
+	sendAt(t, calc, testTargetID, base, time.Minute, 2*time.Minute)
+	time.Sleep(shortWait)
+	require.NoError(t, calc.saveSnapshot())
+	records = readHistoryJournal(t, path+historyJournalSuffix)
+	require.Len(t, records, 2)
+	minutes := records[1].Levels[0]
+	require.Len(t, minutes.Buckets, 2)
+	assert.Equal(t, base.Add(time.Minute).UnixNano(), minutes.Buckets[0].Start)
+	require.Len(t, records[1].Levels[1].Buckets, 1)
+	assert.Equal(t, int64(4), records[1].Levels[1].Buckets[0].Count)
+
+	// Nothing changed, nothing written
+	require.NoError(t, calc.saveSnapshot())
+	assert.Len(t, readHistoryJournal(t, path+historyJournalSuffix), 2)
+	stop()
+
+	// Replaying the journal keeps the latest version of each bucket
+	restored := NewMetricsCalculatorWithConfig(config)
+	require.NoError(t, restored.restoreSnapshot())
+	series := restored.GetAllMetrics()[0].SeriesId
+	history, err := restored.History(series, base, base.Add(time.Hour), time.Minute)
+	require.NoError(t, err)
+	require.Len(t, history.Buckets, 3)
+	for i, count := range []int64{2, 1, 1} {
+		assert.Equal(t, count, history.Buckets[i].Count, "bucket %d", i)
+	}
+	history, err = restored.History(series, base, base.Add(time.Hour), time.Hour)
+	require.NoError(t, err)
+	require.Len(t, history.Buckets, 1)
+	assert.Equal(t, int64(4), history.Buckets[0].Count)
+}
+
+func TestHistoryJournalTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.snapshot")
+	config := Config{SnapshotPath: path}
+	calc := NewMetricsCalculatorWithConfig(config)
+	stop := runCalculator(t, calc)
+
+	base := time.Now().Truncate(time.Hour)
+	sendAt(t, calc, testTargetID, base, 0, 10*time.Second, 20*time.Second)
+	time.Sleep(shortWait)
+	stop()
+
+	// A checkpoint cut short leaves a partial record behind
+	file, err := os.OpenFile(path+historyJournalSuffix, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0x40, 0x0a})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	// The complete records are still restored
+	restored := NewMetricsCalculatorWithConfig(config)
+	assert.Error(t, restored.restoreSnapshot())
+	series := restored.GetAllMetrics()[0].SeriesId
+	history, err := restored.History(series, base, base.Add(time.Hour), time.Minute)
+	require.NoError(t, err)
+	require.Len(t, history.Buckets, 1)
+	assert.Equal(t, int64(2), history.Buckets[0].Count)
+
+	// And the next checkpoint rewrites the journal
+	require.NoError(t, restored.saveSnapshot())
+	records := readHistoryJournal(t, path+historyJournalSuffix)
+	require.Len(t, records, 1)
+	assert.Equal(t, int64(2), records[0].Levels[0].Buckets[0].Count)
+}
@@ -0,0 +1,169 @@
+package calculator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+// State is the lifecycle state of a MetricsCalculator
+type State int32
+
+const (
+	// StateStopped is not processing events; it is the initial state
+	StateStopped State = iota
+	// StateRunning is processing events
+	StateRunning
+	// StatePaused is running but not processing events
+	StatePaused
+	// StateClosed is torn down by Close and can't be started again
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStopped:
+		return "stopped"
+	case StateRunning:
+		return "running"
+	case StatePaused:
+		return "paused"
+	case StateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("State(%d)", int32(s))
+	}
+}
+
+// PausePolicy decides what happens to events sent while the calculator is
+// paused
+type PausePolicy int
+
+const (
+	// PauseQueue keeps events queued until the calculator resumes, up to the
+	// queue capacity
+	PauseQueue PausePolicy = iota
+	// PauseDrop rejects events with ErrPaused
+	PauseDrop
+)
+
+var (
+	ErrInvalidState = errors.New("invalid calculator state")
+	ErrPaused       = errors.New("calculator is paused")
+)
+
+// State returns the current lifecycle state
+func (c *MetricsCalculator) State() State {
+	return State(c.state.Load())
+}
+
+// setStateLocked changes the state and wakes the Start loop; callers hold
+// stateMu
+func (c *MetricsCalculator) setStateLocked(state State) {
+	c.state.Store(int32(state))
+	select {
+	case c.wakeCh <- struct{}{}:
+	default:
+		// A wakeup is already pending
+	}
+}
+
+// begin moves a stopped calculator to running for a new run of Start. It
+// returns the channels of the run and whether this is the first run.
+func (c *MetricsCalculator) begin() (stopCh, done chan struct{}, first bool, err error) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	if state := c.State(); state != StateStopped {
+		return nil, nil, false, fmt.Errorf("%w: cannot start while %s", ErrInvalidState, state)
+	}
+	c.stopCh = make(chan struct{})
+	c.done = make(chan struct{})
+	first = !c.started
+	c.started = true
+	c.setStateLocked(StateRunning)
+	return c.stopCh, c.done, first, nil
+}
+
+// end marks the run of Start that owns done as finished
+func (c *MetricsCalculator) end(done chan struct{}) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	c.stopCh = nil
+	if state := c.State(); state == StateRunning || state == StatePaused {
+		c.setStateLocked(StateStopped)
+	}
+	close(done)
+}
+
+// Pause stops processing events without stopping the calculator. Events
+// sent meanwhile are handled according to Config.PausePolicy.
+func (c *MetricsCalculator) Pause() error {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	if state := c.State(); state != StateRunning {
+		return fmt.Errorf("%w: cannot pause while %s", ErrInvalidState, state)
+	}
+	c.setStateLocked(StatePaused)
+	return nil
+}
+
+// Resume continues processing events after Pause, starting with the events
+// queued meanwhile
+func (c *MetricsCalculator) Resume() error {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	if state := c.State(); state != StatePaused {
+		return fmt.Errorf("%w: cannot resume while %s", ErrInvalidState, state)
+	}
+	c.setStateLocked(StateRunning)
+	return nil
+}
+
+// Close stops the calculator and releases it for good: subscriber channels
+// are closed and the series are dropped. It's safe to call Close multiple
+// times.
+func (c *MetricsCalculator) Close() {
+	for {
+		c.stateMu.Lock()
+		state := c.State()
+		if state == StateClosed {
+			c.stateMu.Unlock()
+			return
+		}
+		if state == StateStopped {
+			// Closing under the same lock keeps a concurrent Start out
+			c.setStateLocked(StateClosed)
+			c.stateMu.Unlock()
+			break
+		}
+		c.stateMu.Unlock()
+		c.Stop()
+	}
+
+	c.metricsMu.Lock()
+	c.metrics = nil
+	c.byKey = nil
+	c.discovery = make(discoveryIndex)
+	c.metricsMu.Unlock()
+
+	// Close all subscriber channels
+	c.subscribersMu.Lock()
+	for ch := range c.subscribers {
+		close(ch)
+	}
+	c.subscribers = make(map[chan *proto.MetricsUpdate]struct{})
+	for ch := range c.heatmapSubscribers {
+		close(ch)
+	}
+	c.heatmapSubscribers = make(map[chan *proto.HeatmapFrame]struct{})
+	c.subscribersMu.Unlock()
+	c.closeTopKSubscribers()
+
+	// Finish the running capture, if any, so its files can be read
+	c.StopCapture()
+}
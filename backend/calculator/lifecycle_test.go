@@ -0,0 +1,148 @@
+package calculator
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifecycleRestart(t *testing.T) {
+	calc := NewMetricsCalculator()
+	defer calc.Close()
+	assert.Equal(t, StateStopped, calc.State())
+
+	sub := calc.Subscribe()
+	stop := runCalculator(t, calc)
+	err := calc.Start(t.Context())
+	assert.ErrorIs(t, err, ErrInvalidState, "Only one run at a time")
+
+	base := time.Now()
+	sendAt(t, calc, testTargetID, base, 0, 100*time.Millisecond)
+	time.Sleep(shortWait)
+
+	stop()
+	assert.Equal(t, StateStopped, calc.State())
+
+	// Events sent while stopped wait for the next run
+	sendAt(t, calc, testTargetID, base, 300*time.Millisecond)
+	stop = runCalculator(t, calc)
+	time.Sleep(shortWait)
+
+	updates := calc.GetAllMetrics()
+	require.Len(t, updates, 1, "Series survive a restart")
+	assert.Equal(t, int64(3), updates[0].Count)
+	assert.Equal(t, 200.0, updates[0].Max)
+
+	// The subscriber from before the restart still receives updates
+	var last int64
+	for len(sub) > 0 {
+		last = (<-sub).Count
+	}
+	assert.Equal(t, int64(3), last)
+	stop()
+}
+
+func TestLifecyclePauseQueue(t *testing.T) {
+	calc := NewMetricsCalculator()
+	defer calc.Close()
+	stop := runCalculator(t, calc)
+	defer stop()
+
+	assert.ErrorIs(t, calc.Resume(), ErrInvalidState)
+	require.NoError(t, calc.Pause())
+	assert.Equal(t, StatePaused, calc.State())
+	assert.ErrorIs(t, calc.Pause(), ErrInvalidState)
+
+	sendAt(t, calc, testTargetID, time.Now(), 0, 100*time.Millisecond)
+	time.Sleep(shortWait)
+	assert.Empty(t, calc.GetAllMetrics(), "Nothing is processed while paused")
+
+	require.NoError(t, calc.Resume())
+	time.Sleep(shortWait)
+	assert.Len(t, calc.GetAllMetrics(), 1, "Queued events are processed on resume")
+}
+
+func TestLifecyclePauseDrop(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{PausePolicy: PauseDrop})
+	defer calc.Close()
+	stop := runCalculator(t, calc)
+
+	require.NoError(t, calc.Pause())
+	assert.ErrorIs(t, calc.ProcessEvent(createTestEvent(testTargetID, testKey, nil)), ErrPaused)
+
+	// Stopping a paused calculator works too
+	stop()
+	assert.Equal(t, StateStopped, calc.State())
+}
+
+func TestLifecycleContextCancel(t *testing.T) {
+	calc := NewMetricsCalculator()
+	defer calc.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- calc.Start(ctx)
+	}()
+	require.Eventually(t, func() bool { return calc.State() == StateRunning }, time.Second, time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-errChan, context.Canceled)
+	assert.Equal(t, StateStopped, calc.State())
+}
+
+func TestLifecycleClose(t *testing.T) {
+	calc := NewMetricsCalculator()
+	sub := calc.Subscribe()
+	stop := runCalculator(t, calc)
+
+	calc.Close()
+	stop()
+	assert.Equal(t, StateClosed, calc.State())
+
+	_, open := <-sub
+	assert.False(t, open, "Close closes subscriber channels")
+	assert.Error(t, calc.ProcessEvent(createTestEvent(testTargetID, testKey, nil)))
+	assert.ErrorIs(t, calc.Start(t.Context()), ErrInvalidState)
+
+	calc.Close()
+}
+
+func TestLifecycleConcurrentStop(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{SnapshotPath: filepath.Join(t.TempDir(), "metrics.snapshot")})
+	stop := runCalculator(t, calc)
+
+	// Holding up the final checkpoint keeps the run stopping
+	calc.snapshotMu.Lock()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		calc.Stop()
+	}()
+	require.Eventually(t, func() bool {
+		calc.stateMu.Lock()
+		defer calc.stateMu.Unlock()
+		return calc.stopCh == nil
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, StateRunning, calc.State())
+
+	// Stopping or closing meanwhile waits for the same run to end
+	for _, shutdown := range []func(){calc.Stop, calc.Close, calc.Stop} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shutdown()
+		}()
+	}
+	time.Sleep(shortWait)
+	calc.snapshotMu.Unlock()
+	wg.Wait()
+	stop()
+	assert.Equal(t, StateClosed, calc.State())
+}
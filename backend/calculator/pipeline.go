@@ -0,0 +1,219 @@
+package calculator
+
+import (
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const (
+	// DefaultPipelineTimeout is how long a job is tracked when
+	// Config.PipelineTimeout is not set
+	DefaultPipelineTimeout = 10 * time.Minute
+
+	// DefaultPipelineCapacity bounds the jobs in flight when
+	// Config.PipelineCapacity is not set
+	DefaultPipelineCapacity = 100000
+
+	// PipelineEndToEnd names the series measuring a job from its first
+	// stage to its final one, or to its last one if it timed out without a
+	// declared final stage
+	PipelineEndToEnd = "end-to-end"
+
+	// minPipelineCompaction keeps small trackers from compacting on every job
+	minPipelineCompaction = 64
+)
+
+// PipelineConfig declares the final stage of the stage-tagged series
+// matching the patterns. Patterns use path.Match syntax; an empty pattern
+// matches everything. The first matching pipeline applies. Without one, a
+// job's end-to-end latency is only known once it times out.
+type PipelineConfig struct {
+	TargetPattern string
+	KeyPattern    string
+	FinalStage    string
+}
+
+func (cfg *PipelineConfig) matches(targetID, key string) bool {
+	return matchPattern(cfg.TargetPattern, targetID) && matchPattern(cfg.KeyPattern, key)
+}
+
+// finalStage returns the stage completing the jobs of a series, or "" when
+// none is declared
+func (c *MetricsCalculator) finalStage(targetID, key string) string {
+	for i := range c.config.Pipelines {
+		cfg := &c.config.Pipelines[i]
+		if cfg.matches(targetID, key) {
+			return cfg.FinalStage
+		}
+	}
+	return ""
+}
+
+// pipelineTransitionKey is the key of the series measuring the time between
+// two consecutive stages, e.g. "jobs/enqueue->start"
+func pipelineTransitionKey(key, from, to string) string {
+	return key + "/" + from + "->" + to
+}
+
+// pipelineEndToEndKey is the key of the end-to-end series, e.g.
+// "jobs/end-to-end"
+func pipelineEndToEndKey(key string) string {
+	return key + "/" + PipelineEndToEnd
+}
+
+// pipelineJob is the progress of a job through its stages
+type pipelineJob struct {
+	firstTimestamp int64 // Server timestamp of the first stage
+	stage          string
+	timestamp      int64        // Server timestamp of the latest stage
+	created        int64        // Receive time in Unix nanoseconds
+	stages         int          // Distinct stages seen
+	last           *proto.Event // Event of the latest stage
+}
+
+type pipelineEntry struct {
+	key string
+	job *pipelineJob
+}
+
+// pipelineTracker follows jobs from stage to stage for a time window,
+// bounded to a maximum number of jobs. It is only used from the calculator
+// goroutine and needs no locking.
+type pipelineTracker struct {
+	timeout  int64
+	capacity int
+
+	jobs  map[string]*pipelineJob
+	order []pipelineEntry // Oldest first; entries of finished jobs linger
+}
+
+func newPipelineTracker(timeout time.Duration, capacity int) *pipelineTracker {
+	return &pipelineTracker{
+		timeout:  int64(timeout),
+		capacity: capacity,
+		jobs:     make(map[string]*pipelineJob),
+	}
+}
+
+// expire forgets the jobs that timed out by now and returns them
+func (p *pipelineTracker) expire(now time.Time) []*pipelineJob {
+	cutoff := now.UnixNano() - p.timeout
+	var timedOut []*pipelineJob
+	expired := 0
+	for expired < len(p.order) && p.order[expired].job.created <= cutoff {
+		if entry := p.order[expired]; p.jobs[entry.key] == entry.job {
+			delete(p.jobs, entry.key)
+			timedOut = append(timedOut, entry.job)
+		}
+		expired++
+	}
+	p.order = p.order[expired:]
+	return timedOut
+}
+
+// advance moves a job to the stage of event. It returns the job as it was
+// before the move, or false if this is its first stage. Repeating the
+// current stage leaves the job untouched.
+func (p *pipelineTracker) advance(key string, event *proto.Event, now time.Time) (previous pipelineJob, ok bool) {
+	stage, timestamp := event.Stage, event.ServerTimestamp
+
+	// Evict the oldest jobs beyond the capacity
+	evicted := 0
+	for evicted < len(p.order) && len(p.jobs) >= p.capacity {
+		if entry := p.order[evicted]; p.jobs[entry.key] == entry.job {
+			delete(p.jobs, entry.key)
+		}
+		evicted++
+	}
+	p.order = p.order[evicted:]
+
+	// Drop the entries of finished jobs once they outnumber the live ones
+	if len(p.order) > 2*len(p.jobs)+minPipelineCompaction {
+		live := p.order[:0]
+		for _, entry := range p.order {
+			if p.jobs[entry.key] == entry.job {
+				live = append(live, entry)
+			}
+		}
+		p.order = live
+	}
+
+	job, exists := p.jobs[key]
+	if !exists {
+		job = &pipelineJob{
+			firstTimestamp: timestamp,
+			stage:          stage,
+			timestamp:      timestamp,
+			created:        now.UnixNano(),
+			stages:         1,
+			last:           event,
+		}
+		p.jobs[key] = job
+		p.order = append(p.order, pipelineEntry{key: key, job: job})
+		return pipelineJob{}, false
+	}
+	if job.stage == stage {
+		return pipelineJob{}, false
+	}
+
+	previous = *job
+	job.stage = stage
+	job.timestamp = timestamp
+	job.stages++
+	job.last = event
+	return previous, true
+}
+
+// finish forgets a completed job
+func (p *pipelineTracker) finish(key string) {
+	delete(p.jobs, key)
+}
+
+// stageLatency is a latency derived from the stages of a job, carried by an
+// event of the derived series
+type stageLatency struct {
+	event     *proto.Event
+	latencyMs float64
+}
+
+// trackPipeline advances the job of a stage-tagged event and returns the
+// latencies it closes: the transition from the previous stage and, on the
+// final stage, the end-to-end latency. Jobs without a declared final stage
+// that timed out meanwhile end at the last stage they reached.
+func (c *MetricsCalculator) trackPipeline(event *proto.Event, receivedAt time.Time) []stageLatency {
+	if event.Stage == "" || event.JobId == "" {
+		return nil
+	}
+
+	var latencies []stageLatency
+	for _, job := range c.pipelines.expire(receivedAt) {
+		if job.stages > 1 && c.finalStage(job.last.TargetId, job.last.Key) == "" {
+			latencies = append(latencies, newStageLatency(job.last, pipelineEndToEndKey(job.last.Key), job.firstTimestamp))
+		}
+	}
+
+	jobKey := event.TargetId + "\x00" + event.Key + "\x00" + event.JobId
+	previous, ok := c.pipelines.advance(jobKey, event, receivedAt)
+	if !ok {
+		return latencies
+	}
+
+	latencies = append(latencies,
+		newStageLatency(event, pipelineTransitionKey(event.Key, previous.stage, event.Stage), previous.timestamp))
+	if event.Stage == c.finalStage(event.TargetId, event.Key) {
+		c.pipelines.finish(jobKey)
+		latencies = append(latencies, newStageLatency(event, pipelineEndToEndKey(event.Key), previous.firstTimestamp))
+	}
+	return latencies
+}
+
+func newStageLatency(event *proto.Event, key string, since int64) stageLatency {
+	derived := protobuf.Clone(event).(*proto.Event)
+	derived.Key = key
+	return stageLatency{
+		event:     derived,
+		latencyMs: float64(event.ServerTimestamp-since) / float64(time.Millisecond),
+	}
+}
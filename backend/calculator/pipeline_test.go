@@ -0,0 +1,189 @@
+package calculator
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stageEvent returns an event of a job stage at timestamp
+func stageEvent(stage string, timestamp int64) *proto.Event {
+	return &proto.Event{Stage: stage, ServerTimestamp: timestamp}
+}
+
+func TestPipelineTrackerAdvance(t *testing.T) {
+	p := newPipelineTracker(time.Minute, 10)
+	now := time.Now()
+
+	_, ok := p.advance("job", stageEvent("enqueue", 100), now)
+	assert.False(t, ok, "The first stage closes nothing")
+
+	_, ok = p.advance("job", stageEvent("enqueue", 150), now)
+	assert.False(t, ok, "A repeated stage is ignored")
+
+	previous, ok := p.advance("job", stageEvent("start", 200), now)
+	require.True(t, ok)
+	assert.Equal(t, "enqueue", previous.stage)
+	assert.Equal(t, int64(100), previous.timestamp)
+	assert.Equal(t, int64(100), previous.firstTimestamp)
+
+	// The job has timed out by its next stage and starts over
+	later := now.Add(61 * time.Second)
+	timedOut := p.expire(later)
+	require.Len(t, timedOut, 1)
+	assert.Equal(t, "start", timedOut[0].last.Stage)
+	assert.Equal(t, 2, timedOut[0].stages)
+	_, ok = p.advance("job", stageEvent("finish", 300), later)
+	assert.False(t, ok)
+}
+
+func TestPipelineTrackerCapacity(t *testing.T) {
+	p := newPipelineTracker(time.Hour, 3)
+	now := time.Now()
+
+	for _, job := range []string{"a", "b", "c", "d"} {
+		p.advance(job, stageEvent("enqueue", 0), now)
+	}
+	assert.Len(t, p.jobs, 3)
+	_, ok := p.advance("a", stageEvent("start", 0), now)
+	assert.False(t, ok, "The oldest job was evicted")
+	_, ok = p.advance("d", stageEvent("start", 0), now)
+	assert.True(t, ok)
+}
+
+func TestPipelineTrackerCompaction(t *testing.T) {
+	p := newPipelineTracker(time.Hour, DefaultPipelineCapacity)
+	now := time.Now()
+
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		p.advance(key, stageEvent("enqueue", 0), now)
+		p.finish(key)
+	}
+	assert.Empty(t, p.jobs)
+	assert.LessOrEqual(t, len(p.order), minPipelineCompaction+1)
+}
+
+func TestPipelineSeries(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{
+		Pipelines: []PipelineConfig{{KeyPattern: "jobs", FinalStage: "ack"}},
+	})
+	base := time.Now()
+
+	send := func(jobID, stage string, offset time.Duration) {
+		event := createTestEvent(testTargetID, "jobs", nil)
+		event.ServerTimestamp = base.Add(offset).UnixNano()
+		event.Stage = stage
+		event.JobId = jobID
+		calc.handleEvent(event, base.Add(offset))
+	}
+	send("job-1", "enqueue", 0)
+	send("job-2", "enqueue", 10*time.Millisecond)
+	send("job-1", "start", 50*time.Millisecond)
+	send("job-2", "start", 100*time.Millisecond)
+	send("job-1", "finish", 250*time.Millisecond)
+	send("job-2", "finish", 400*time.Millisecond)
+	send("job-1", "ack", 260*time.Millisecond)
+	send("job-2", "ack", 420*time.Millisecond)
+
+	series := func(key string) *Metrics {
+		m, exists := calc.metric(seriesKey(testTargetID, key, map[string]string{"tier": testTier}))
+		require.True(t, exists, key)
+		return m
+	}
+
+	enqueueStart := series("jobs/enqueue->start")
+	assert.Equal(t, int64(2), enqueueStart.Count())
+	assert.InDelta(t, 50.0, enqueueStart.Min(), 1e-6)
+	assert.InDelta(t, 90.0, enqueueStart.Max(), 1e-6)
+
+	startFinish := series("jobs/start->finish")
+	assert.InDelta(t, 200.0, startFinish.Min(), 1e-6)
+	assert.InDelta(t, 300.0, startFinish.Max(), 1e-6)
+
+	endToEnd := series("jobs/end-to-end")
+	assert.Equal(t, int64(2), endToEnd.Count())
+	assert.InDelta(t, 260.0, endToEnd.Min(), 1e-6)
+	assert.InDelta(t, 410.0, endToEnd.Max(), 1e-6)
+	assert.Empty(t, calc.pipelines.jobs, "Jobs are forgotten at their final stage")
+
+	// Derived series are listed like any other
+	var keys []string
+	for _, update := range calc.GetAllMetrics() {
+		keys = append(keys, update.Key)
+	}
+	assert.Contains(t, keys, "jobs/finish->ack")
+	assert.Contains(t, keys, "jobs/end-to-end")
+}
+
+func TestPipelineEndToEndOnTimeout(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{
+		Pipelines:       []PipelineConfig{{KeyPattern: "declared", FinalStage: "ack"}},
+		PipelineTimeout: time.Second,
+	})
+	base := time.Now()
+
+	send := func(key, jobID, stage string, offset time.Duration) {
+		event := createTestEvent(testTargetID, key, nil)
+		event.ServerTimestamp = base.Add(offset).UnixNano()
+		event.Stage = stage
+		event.JobId = jobID
+		calc.handleEvent(event, base.Add(offset))
+	}
+	send("jobs", "job-1", "enqueue", 0)
+	send("jobs", "job-1", "start", 100*time.Millisecond)
+	send("jobs", "job-1", "finish", 300*time.Millisecond)
+	send("jobs", "job-2", "enqueue", 400*time.Millisecond)
+	send("declared", "job-3", "enqueue", 0)
+	send("declared", "job-3", "start", 100*time.Millisecond)
+
+	endToEnd := seriesKey(testTargetID, "jobs/end-to-end", map[string]string{"tier": testTier})
+	_, exists := calc.metric(endToEnd)
+	assert.False(t, exists, "Jobs are only ended once they time out")
+
+	// The next stage event expires the jobs that timed out
+	send("jobs", "job-4", "enqueue", 1100*time.Millisecond)
+	m, exists := calc.metric(endToEnd)
+	require.True(t, exists)
+	assert.Equal(t, int64(1), m.Count(), "A job with a single stage has no end-to-end latency")
+	assert.InDelta(t, 300.0, m.Max(), 1e-6)
+
+	// A job that never reached its declared final stage didn't complete
+	_, exists = calc.metric(seriesKey(testTargetID, "declared/end-to-end", map[string]string{"tier": testTier}))
+	assert.False(t, exists)
+}
+
+func TestPipelineSeriesNotified(t *testing.T) {
+	calc := NewMetricsCalculator()
+	stop := runCalculator(t, calc)
+	defer stop()
+	ch := calc.Subscribe()
+
+	base := time.Now()
+	for i, stage := range []string{"enqueue", "start"} {
+		event := createTestEvent(testTargetID, "jobs", nil)
+		event.ServerTimestamp = base.Add(time.Duration(i) * 30 * time.Millisecond).UnixNano()
+		event.Stage = stage
+		event.JobId = "job-1"
+		require.NoError(t, calc.ProcessEvent(event))
+	}
+
+	var transition *proto.MetricsUpdate
+	timeout := time.After(time.Second)
+	for transition == nil {
+		select {
+		case update := <-ch:
+			if update.Key == "jobs/enqueue->start" {
+				transition = update
+			}
+		case <-timeout:
+			t.Fatal("No update for the transition series")
+		}
+	}
+	assert.Equal(t, int64(1), transition.Count)
+	assert.InDelta(t, 30.0, transition.Avg, 1e-6)
+}
@@ -0,0 +1,159 @@
+package calculator
+
+import (
+	"container/ring"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+// ScheduleConfig declares that the series matching the patterns are expected
+// to fire every Period. Patterns use path.Match syntax; an empty pattern
+// matches everything. The first matching schedule applies.
+type ScheduleConfig struct {
+	TargetPattern string
+	KeyPattern    string
+	Period        time.Duration
+	Tolerance     time.Duration // Lateness within ±Tolerance counts as on time
+}
+
+func (cfg *ScheduleConfig) matches(targetID, key string) bool {
+	return matchPattern(cfg.TargetPattern, targetID) && matchPattern(cfg.KeyPattern, key)
+}
+
+// newSchedule returns the schedule tracking of a series, or nil when no
+// schedule is declared for it
+func (c *MetricsCalculator) newSchedule(targetID, key string) *seriesSchedule {
+	for i := range c.config.Schedules {
+		cfg := &c.config.Schedules[i]
+		if cfg.Period > 0 && cfg.matches(targetID, key) {
+			return &seriesSchedule{
+				period:    float64(cfg.Period) / float64(time.Millisecond),
+				tolerance: float64(cfg.Tolerance) / float64(time.Millisecond),
+				lateness:  ring.New(MaxSamples),
+			}
+		}
+	}
+	return nil
+}
+
+// seriesSchedule measures ticks against a declared period. The first tick
+// fixes the phase of the schedule; every later tick is placed in the
+// scheduled slot nearest to it and its lateness measured from that slot, so
+// one late tick doesn't shift the ones after it. Skipped slots count as
+// missed, and extra ticks in a slot that already has one as early.
+type seriesSchedule struct {
+	period    float64 // Milliseconds
+	tolerance float64 // Milliseconds
+
+	anchored bool
+	anchor   float64 // Timestamp of slot 0 in milliseconds
+	lastSlot int64   // Latest slot a tick was placed in
+
+	onTime int64
+	late   int64
+	early  int64
+	missed int64
+
+	lateness *ring.Ring // Recent lateness in milliseconds, negative when early
+}
+
+// record places a tick at timestampMs
+func (s *seriesSchedule) record(timestampMs float64) {
+	if !s.anchored {
+		s.anchored, s.anchor, s.lastSlot = true, timestampMs, 0
+		return
+	}
+
+	slot := int64(math.Round((timestampMs - s.anchor) / s.period))
+	if slot <= s.lastSlot {
+		// The slot already has its tick, so this is an extra one. It counts
+		// as early for the next slot, which is still expected.
+		s.early++
+		s.addLateness(timestampMs - s.anchor - float64(s.lastSlot+1)*s.period)
+		return
+	}
+	s.missed += slot - s.lastSlot - 1
+	s.lastSlot = slot
+
+	lateness := timestampMs - s.anchor - float64(slot)*s.period
+	switch {
+	case lateness > s.tolerance:
+		s.late++
+	case lateness < -s.tolerance:
+		s.early++
+	default:
+		s.onTime++
+	}
+	s.addLateness(lateness)
+}
+
+func (s *seriesSchedule) addLateness(lateness float64) {
+	s.lateness = s.lateness.Next()
+	s.lateness.Value = lateness
+}
+
+// reanchor makes the next tick fix the phase again, after the producer's
+// clock stepped
+func (s *seriesSchedule) reanchor() {
+	s.anchored = false
+}
+
+func (s *seriesSchedule) stats() *proto.ScheduleStats {
+	stats := &proto.ScheduleStats{
+		Period:    s.period,
+		Tolerance: s.tolerance,
+		OnTime:    s.onTime,
+		Late:      s.late,
+		Early:     s.early,
+		Missed:    s.missed,
+	}
+
+	samples := s.latenessSamples()
+	if len(samples) == 0 {
+		return stats
+	}
+
+	var sum float64
+	for _, v := range samples {
+		sum += v
+	}
+	stats.LatenessAvg = sum / float64(len(samples))
+
+	sort.Float64s(samples)
+	stats.LatenessMin = samples[0]
+	stats.LatenessMax = samples[len(samples)-1]
+	stats.LatenessP90 = samples[int(float64(len(samples)-1)*P90Percentile/100.0)]
+	return stats
+}
+
+// latenessSamples returns the retained lateness values, oldest first
+func (s *seriesSchedule) latenessSamples() []float64 {
+	var samples []float64
+	s.lateness.Next().Do(func(v any) {
+		if v != nil {
+			samples = append(samples, v.(float64))
+		}
+	})
+	return samples
+}
+
+// restore loads persisted counters and lateness samples. The phase isn't
+// persisted; the first tick after a restart fixes it again.
+func (s *seriesSchedule) restore(stats *proto.ScheduleStats, lateness []float64) {
+	if stats != nil {
+		s.onTime = stats.OnTime
+		s.late = stats.Late
+		s.early = stats.Early
+		s.missed = stats.Missed
+	}
+	if len(lateness) > MaxSamples {
+		lateness = lateness[len(lateness)-MaxSamples:]
+	}
+	for _, v := range lateness {
+		s.lateness = s.lateness.Next()
+		s.lateness.Value = v
+	}
+}
@@ -0,0 +1,131 @@
+package calculator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleStats(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{
+		Schedules: []ScheduleConfig{
+			{KeyPattern: "heartbeat-*", Period: time.Second, Tolerance: 50 * time.Millisecond},
+		},
+	})
+
+	assert.Nil(t, calc.newSchedule(testTargetID, "api-call"), "Unscheduled keys are not tracked")
+	s := calc.newSchedule(testTargetID, "heartbeat-db")
+	require.NotNil(t, s)
+
+	for _, timestamp := range []float64{
+		0,    // fixes the phase
+		1000, // on time
+		2020, // on time
+		3300, // late
+		4000, // on time: lateness is measured from the schedule, not the late tick
+		4700, // early
+		8000, // two missed slots, then on time
+		8300, // the slot already has its tick: early for the next one
+	} {
+		s.record(timestamp)
+	}
+
+	stats := s.stats()
+	assert.Equal(t, 1000.0, stats.Period)
+	assert.Equal(t, 50.0, stats.Tolerance)
+	assert.Equal(t, int64(4), stats.OnTime)
+	assert.Equal(t, int64(1), stats.Late)
+	assert.Equal(t, int64(2), stats.Early)
+	assert.Equal(t, int64(2), stats.Missed)
+	assert.Equal(t, -700.0, stats.LatenessMin)
+	assert.Equal(t, 300.0, stats.LatenessMax)
+	assert.InDelta(t, -680.0/7, stats.LatenessAvg, 0.001)
+	assert.Equal(t, 20.0, stats.LatenessP90)
+}
+
+func TestScheduleAnchored(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{
+		Schedules: []ScheduleConfig{{Period: time.Second, Tolerance: 50 * time.Millisecond}},
+	})
+	s := calc.newSchedule(testTargetID, testKey)
+	require.NotNil(t, s)
+
+	// One late heartbeat doesn't make the next on-schedule one early
+	for _, timestamp := range []float64{0, 1000, 2000, 3300, 4000, 5000} {
+		s.record(timestamp)
+	}
+	stats := s.stats()
+	assert.Equal(t, int64(4), stats.OnTime)
+	assert.Equal(t, int64(1), stats.Late)
+	assert.Zero(t, stats.Early)
+	assert.Zero(t, stats.Missed)
+
+	// After a clock step the next tick fixes a new phase
+	s.reanchor()
+	s.record(100500)
+	s.record(101500)
+	stats = s.stats()
+	assert.Equal(t, int64(5), stats.OnTime)
+	assert.Zero(t, stats.Missed)
+}
+
+func TestScheduleExtraTicks(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{
+		Schedules: []ScheduleConfig{{Period: time.Second, Tolerance: 50 * time.Millisecond}},
+	})
+
+	for _, tc := range []struct {
+		name                  string
+		timestamps            []float64
+		onTime, early, missed int64
+		latenessMin           float64
+	}{
+		// A duplicate doesn't push the following ticks into later slots
+		{"duplicate", []float64{0, 1000, 1000, 2000, 3000, 4000}, 4, 1, 0, -1000},
+		// One early tick takes its slot from the on-time one after it
+		{"early", []float64{0, 1000, 2000, 2600, 3000, 4000, 5000, 6000, 7000}, 6, 2, 0, -1000},
+		// A tick more than half a period late lands in the next slot
+		{"very late", []float64{0, 1000, 2600, 3000, 4000, 5000}, 3, 2, 1, -1000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := calc.newSchedule(testTargetID, testKey)
+			for _, timestamp := range tc.timestamps {
+				s.record(timestamp)
+			}
+			stats := s.stats()
+			assert.Equal(t, tc.onTime, stats.OnTime)
+			assert.Equal(t, tc.early, stats.Early)
+			assert.Equal(t, tc.missed, stats.Missed)
+			assert.Zero(t, stats.Late)
+			assert.Equal(t, tc.latenessMin, stats.LatenessMin)
+		})
+	}
+}
+
+func TestScheduleInUpdates(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{
+		Schedules: []ScheduleConfig{{TargetPattern: "cron-*", Period: 100 * time.Millisecond}},
+	})
+	sub := calc.Subscribe()
+	stop := runCalculator(t, calc)
+	defer stop()
+
+	base := time.Now()
+	for _, offset := range []int{0, 100, 200, 400} {
+		event := createTestEvent("cron-nightly", testKey, nil)
+		event.ServerTimestamp = base.Add(time.Duration(offset) * time.Millisecond).UnixNano()
+		require.NoError(t, calc.ProcessEvent(event))
+	}
+	time.Sleep(shortWait)
+
+	require.Len(t, sub, 4)
+	for range 3 {
+		<-sub
+	}
+	update := <-sub
+	require.NotNil(t, update.Schedule)
+	assert.Equal(t, int64(3), update.Schedule.OnTime)
+	assert.Equal(t, int64(1), update.Schedule.Missed)
+}
@@ -0,0 +1,136 @@
+package calculator
+
+import (
+	"math"
+	"sort"
+
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+const (
+	// SketchAccuracy is the relative error of quantiles estimated by a
+	// quantileSketch
+	SketchAccuracy = 0.01
+
+	// sketchMinValue is the smallest value in milliseconds told apart from
+	// zero; anything at or below it is counted as zero
+	sketchMinValue = 1e-6
+)
+
+var (
+	sketchGamma    = (1 + SketchAccuracy) / (1 - SketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+type sketchBin struct {
+	index int32
+	count int64
+}
+
+// quantileSketch estimates quantiles of non-negative values within
+// SketchAccuracy relative error. Values are counted in logarithmically
+// sized bins, so sketches of any two periods can be merged exactly and the
+// size only grows with the spread of the values, not their number.
+type quantileSketch struct {
+	zero int64       // Values at or below sketchMinValue
+	bins []sketchBin // Sorted by index
+}
+
+func sketchIndex(v float64) int32 {
+	return int32(math.Ceil(math.Log(v) / sketchLogGamma))
+}
+
+// sketchValue is the value a bin stands for, within SketchAccuracy of every
+// value counted in it
+func sketchValue(index int32) float64 {
+	return 2 * math.Pow(sketchGamma, float64(index)) / (sketchGamma + 1)
+}
+
+func (s *quantileSketch) add(v float64) {
+	s.addCount(v, 1)
+}
+
+func (s *quantileSketch) addCount(v float64, count int64) {
+	if v <= sketchMinValue {
+		s.zero += count
+		return
+	}
+	s.addBin(sketchIndex(v), count)
+}
+
+func (s *quantileSketch) addBin(index int32, count int64) {
+	// Values usually repeat, so look at the end first
+	n := len(s.bins)
+	if n > 0 && s.bins[n-1].index == index {
+		s.bins[n-1].count += count
+		return
+	}
+	i := sort.Search(n, func(i int) bool { return s.bins[i].index >= index })
+	if i < n && s.bins[i].index == index {
+		s.bins[i].count += count
+		return
+	}
+	s.bins = append(s.bins, sketchBin{})
+	copy(s.bins[i+1:], s.bins[i:])
+	s.bins[i] = sketchBin{index: index, count: count}
+}
+
+// merge adds the values counted by o
+func (s *quantileSketch) merge(o *quantileSketch) {
+	s.zero += o.zero
+	for _, b := range o.bins {
+		s.addBin(b.index, b.count)
+	}
+}
+
+func (s *quantileSketch) count() int64 {
+	n := s.zero
+	for _, b := range s.bins {
+		n += b.count
+	}
+	return n
+}
+
+// quantile estimates the p-th percentile, picking the same rank as
+// Metrics.calculatePercentile
+func (s *quantileSketch) quantile(p float64) float64 {
+	n := s.count()
+	if n == 0 {
+		return 0
+	}
+	rank := int64(float64(n-1) * p / 100.0)
+	if rank < s.zero {
+		return 0
+	}
+	seen := s.zero
+	for _, b := range s.bins {
+		seen += b.count
+		if rank < seen {
+			return sketchValue(b.index)
+		}
+	}
+	return sketchValue(s.bins[len(s.bins)-1].index)
+}
+
+func (s *quantileSketch) toProto() *proto.QuantileSketch {
+	sketch := &proto.QuantileSketch{
+		ZeroCount: s.zero,
+		Indexes:   make([]int32, len(s.bins)),
+		Counts:    make([]int64, len(s.bins)),
+	}
+	for i, b := range s.bins {
+		sketch.Indexes[i] = b.index
+		sketch.Counts[i] = b.count
+	}
+	return sketch
+}
+
+func sketchFromProto(p *proto.QuantileSketch) quantileSketch {
+	s := quantileSketch{zero: p.ZeroCount}
+	for i, index := range p.Indexes {
+		if i < len(p.Counts) {
+			s.addBin(index, p.Counts[i])
+		}
+	}
+	return s
+}
@@ -0,0 +1,53 @@
+package calculator
+
+import (
+	"math/rand/v2"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuantileSketch(t *testing.T) {
+	var s quantileSketch
+	assert.Zero(t, s.quantile(P90Percentile))
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	values := make([]float64, 0, 10000)
+	for range 10000 {
+		v := rng.ExpFloat64() * 50
+		values = append(values, v)
+		s.add(v)
+	}
+	sort.Float64s(values)
+
+	assert.Equal(t, int64(len(values)), s.count())
+	for _, p := range []float64{0, 10, 50, 90, 99, 100} {
+		want := values[int(float64(len(values)-1)*p/100)]
+		assert.InEpsilon(t, want, s.quantile(p), SketchAccuracy, "p%v", p)
+	}
+	// The bins only grow with the spread of the values
+	assert.Less(t, len(s.bins), 1000)
+}
+
+func TestQuantileSketchMerge(t *testing.T) {
+	var low, high, all quantileSketch
+	for i := range 100 {
+		low.add(float64(i))
+		high.add(float64(1000 + i))
+		all.add(float64(i))
+		all.add(float64(1000 + i))
+	}
+	low.add(0)
+	all.add(0)
+
+	low.merge(&high)
+	assert.Equal(t, all, low)
+	assert.Equal(t, int64(2), low.zero)
+	assert.Zero(t, low.quantile(0))
+	assert.InEpsilon(t, 1079.0, low.quantile(P90Percentile), SketchAccuracy)
+
+	restored := sketchFromProto(low.toProto())
+	require.Equal(t, low, restored)
+}
@@ -0,0 +1,219 @@
+package calculator
+
+import (
+	"container/ring"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const (
+	// SnapshotVersion is the on-disk format version written by saveSnapshot.
+	// Snapshots with any other version are ignored on restore. Version 2
+	// stores intervals rather than timestamps in the sample ring.
+	SnapshotVersion = 2
+
+	// DefaultSnapshotInterval is how often state is checkpointed when
+	// Config.SnapshotInterval is not set
+	DefaultSnapshotInterval = 1 * time.Minute
+)
+
+// saveSnapshot checkpoints all series to the configured snapshot file, and
+// their history to the journal next to it. The file is replaced atomically
+// so a crash mid-write keeps the previous checkpoint intact.
+func (c *MetricsCalculator) saveSnapshot() error {
+	if c.config.SnapshotPath == "" {
+		return nil
+	}
+
+	// Held from building to writing, so a checkpoint built before a change
+	// such as a deleted baseline can't be written after the one that has it
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+
+	c.metricsMu.RLock()
+	if c.metrics == nil {
+		// Already stopped; don't overwrite the last checkpoint with nothing
+		c.metricsMu.RUnlock()
+		return nil
+	}
+	series := make([]*Metrics, 0, len(c.metrics))
+	for _, m := range c.metrics {
+		series = append(series, m)
+	}
+	c.metricsMu.RUnlock()
+
+	// Each series is only locked while it is copied, so events keep flowing
+	snapshot := &proto.CalculatorSnapshot{
+		Version:   SnapshotVersion,
+		CreatedAt: time.Now().UnixNano(),
+		Series:    make([]*proto.SeriesSnapshot, 0, len(series)),
+	}
+	for _, m := range series {
+		snapshot.Series = append(snapshot.Series, m.snapshot())
+	}
+	snapshot.Targets = c.TargetStats()
+	snapshot.Baselines = c.Baselines()
+
+	data, err := protobuf.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("marshaling snapshot: %w", err)
+	}
+
+	dir := filepath.Dir(c.config.SnapshotPath)
+	tmp, err := os.CreateTemp(dir, filepath.Base(c.config.SnapshotPath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.config.SnapshotPath); err != nil {
+		return err
+	}
+	return c.saveHistory(series)
+}
+
+// restoreSnapshot loads the series state from the configured snapshot file.
+// A missing file is not an error; the calculator simply starts empty.
+func (c *MetricsCalculator) restoreSnapshot() error {
+	if c.config.SnapshotPath == "" {
+		return nil
+	}
+
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+
+	data, err := os.ReadFile(c.config.SnapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	var snapshot proto.CalculatorSnapshot
+	if err := protobuf.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("unmarshaling snapshot: %w", err)
+	}
+	if snapshot.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d (want %d)", snapshot.Version, SnapshotVersion)
+	}
+
+	for _, t := range snapshot.Targets {
+		c.target(t.TargetId).restore(t)
+	}
+	c.restoreBaselines(snapshot.Baselines)
+
+	c.metricsMu.Lock()
+	defer c.metricsMu.Unlock()
+	for _, s := range snapshot.Series {
+		m := restoreMetrics(s)
+		m.id = seriesKey(s.TargetId, s.Key, s.Metadata)
+		m.history = newSeriesHistory(c.config.HistoryResolutions)
+		m.history.restore(s.History)
+		m.aggregators = c.newAggregators(s.TargetId, s.Key)
+		m.heatmap = c.newSeriesHeatmap()
+		if m.schedule = c.newSchedule(s.TargetId, s.Key); m.schedule != nil {
+			m.schedule.restore(s.Schedule, s.Lateness)
+		}
+		c.addMetricLocked(m)
+	}
+	return c.restoreHistory()
+}
+
+// snapshot captures the persisted state of the series. The history is kept
+// in the history journal instead.
+func (m *Metrics) snapshot() *proto.SeriesSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s := &proto.SeriesSnapshot{
+		TargetId: m.TargetID,
+		Key:      m.Key,
+		Metadata: m.Metadata,
+		Count:    atomic.LoadInt64(&m.count),
+		Min:      atomic.LoadInt64(&m.min),
+		Max:      atomic.LoadInt64(&m.max),
+		Avg:      atomic.LoadInt64(&m.avg),
+		P90:      atomic.LoadInt64(&m.p90),
+
+		Jitter:       atomic.LoadInt64(&m.jitter),
+		LastInterval: m.lastInterval,
+
+		EstimatedCount: m.estimatedCount,
+		FirstWeight:    m.firstWeight,
+		FirstTimestamp: m.firstTimestamp,
+		LastTimestamp:  m.lastTimestamp,
+
+		PreviousTime: m.previousTimeMs,
+		Intervals:    m.intervals,
+	}
+
+	// m.Samples points at the newest sample, so the oldest one follows it
+	m.Samples.Next().Do(func(v any) {
+		if v != nil {
+			s.Samples = append(s.Samples, v.(float64))
+		}
+	})
+	s.MaxExemplar = m.maxExemplar
+	// Copied, as the slice is shifted in place once it is full
+	s.OutlierExemplars = append([]*proto.Exemplar(nil), m.outlierExemplars...)
+	if m.schedule != nil {
+		s.Schedule = m.schedule.stats()
+		s.Lateness = m.schedule.latenessSamples()
+	}
+	return s
+}
+
+// restoreMetrics rebuilds a series from its snapshot
+func restoreMetrics(s *proto.SeriesSnapshot) *Metrics {
+	m := &Metrics{
+		TargetID: s.TargetId,
+		Key:      s.Key,
+		Metadata: s.Metadata,
+		Samples:  ring.New(MaxSamples),
+		count:    s.Count,
+		min:      s.Min,
+		max:      s.Max,
+		avg:      s.Avg,
+		p90:      s.P90,
+
+		jitter:       s.Jitter,
+		lastInterval: s.LastInterval,
+
+		estimatedCount: s.EstimatedCount,
+		firstWeight:    s.FirstWeight,
+		firstTimestamp: s.FirstTimestamp,
+		lastTimestamp:  s.LastTimestamp,
+
+		previousTimeMs: s.PreviousTime,
+		hasPrevious:    s.Count > 0,
+		intervals:      s.Intervals,
+
+		maxExemplar:      s.MaxExemplar,
+		outlierExemplars: s.OutlierExemplars,
+	}
+
+	samples := s.Samples
+	if len(samples) > MaxSamples {
+		samples = samples[len(samples)-MaxSamples:]
+	}
+	for _, v := range samples {
+		m.Samples = m.Samples.Next()
+		m.Samples.Value = v
+	}
+	return m
+}
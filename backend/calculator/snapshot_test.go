@@ -0,0 +1,185 @@
+package calculator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// runCalculator starts calc and returns a function that stops it again
+func runCalculator(t *testing.T, calc *MetricsCalculator) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(t.Context())
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- calc.Start(ctx)
+	}()
+	// Give Start a moment to restore any snapshot
+	time.Sleep(shortWait)
+
+	return func() {
+		calc.Stop()
+		cancel()
+		if err := <-errChan; err != nil && err != context.Canceled {
+			t.Fatalf("Calculator error: %v", err)
+		}
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.snapshot")
+
+	calc := NewMetricsCalculatorWithConfig(Config{SnapshotPath: path})
+	stop := runCalculator(t, calc)
+
+	baseTime := time.Now()
+	for i := range 5 {
+		event := createTestEvent(testTargetID, testKey, map[string]string{"tier": testTier, "region": "us-east"})
+		event.ServerTimestamp = baseTime.Add(time.Duration(i*100) * time.Millisecond).UnixNano()
+		assert.NoError(t, calc.ProcessEvent(event))
+	}
+	time.Sleep(shortWait)
+
+	before := calc.GetAllMetrics()
+	require.Len(t, before, 1)
+	stop()
+
+	_, err := os.Stat(path)
+	require.NoError(t, err, "Stop should write a snapshot")
+
+	restored := NewMetricsCalculatorWithConfig(Config{SnapshotPath: path})
+	stop = runCalculator(t, restored)
+	defer stop()
+
+	after := restored.GetAllMetrics()
+	require.Len(t, after, 1)
+	assert.Equal(t, before[0].Count, after[0].Count)
+	assert.Equal(t, before[0].Min, after[0].Min)
+	assert.Equal(t, before[0].Max, after[0].Max)
+	assert.Equal(t, before[0].Avg, after[0].Avg)
+	assert.Equal(t, before[0].P90, after[0].P90)
+	assert.Equal(t, before[0].Metadata, after[0].Metadata)
+
+	// New events continue the restored series instead of starting over
+	event := createTestEvent(testTargetID, testKey, map[string]string{"region": "us-east", "tier": testTier})
+	event.ServerTimestamp = baseTime.Add(500 * time.Millisecond).UnixNano()
+	assert.NoError(t, restored.ProcessEvent(event))
+	time.Sleep(shortWait)
+
+	after = restored.GetAllMetrics()
+	require.Len(t, after, 1)
+	assert.Equal(t, before[0].Count+1, after[0].Count)
+	assert.Equal(t, 100.0, after[0].Max)
+}
+
+func TestSnapshotWhileRecording(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.snapshot")
+	calc := NewMetricsCalculatorWithConfig(Config{SnapshotPath: path})
+	stop := runCalculator(t, calc)
+	defer stop()
+
+	// Growing intervals keep shifting the full outlier exemplars while
+	// checkpoints are taken; run with -race to catch shared state
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		base := time.Now()
+		offset := time.Duration(0)
+		for i := range 200 {
+			offset += time.Duration(i+1) * time.Millisecond
+			event := createTestEvent(testTargetID, testKey, nil)
+			event.ServerTimestamp = base.Add(offset).UnixNano()
+			assert.NoError(t, calc.ProcessEvent(event))
+		}
+	}()
+	for range 20 {
+		require.NoError(t, calc.saveSnapshot())
+	}
+	<-done
+	time.Sleep(shortWait)
+	require.NoError(t, calc.saveSnapshot())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var snapshot proto.CalculatorSnapshot
+	require.NoError(t, protobuf.Unmarshal(data, &snapshot))
+	require.Len(t, snapshot.Series, 1)
+	assert.Len(t, snapshot.Series[0].OutlierExemplars, MaxOutlierExemplars)
+}
+
+func TestSnapshotUnsupportedVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.snapshot")
+	data, err := protobuf.Marshal(&proto.CalculatorSnapshot{
+		Version: SnapshotVersion + 1,
+		Series:  []*proto.SeriesSnapshot{{TargetId: testTargetID, Key: testKey, Count: 10}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	calc := NewMetricsCalculatorWithConfig(Config{SnapshotPath: path})
+	assert.Error(t, calc.restoreSnapshot())
+	assert.Empty(t, calc.metrics)
+}
+
+func TestSnapshotMissingFile(t *testing.T) {
+	calc := NewMetricsCalculatorWithConfig(Config{
+		SnapshotPath: filepath.Join(t.TempDir(), "missing.snapshot"),
+	})
+	assert.NoError(t, calc.restoreSnapshot())
+}
+
+func TestSnapshotHistoryLevels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.snapshot")
+	config := Config{SnapshotPath: path}
+	calc := NewMetricsCalculatorWithConfig(config)
+	stop := runCalculator(t, calc)
+
+	base := time.Now().Truncate(time.Hour)
+	for i := range 10 {
+		event := createTestEvent(testTargetID, testKey, nil)
+		event.ServerTimestamp = base.Add(time.Duration(i) * 10 * time.Second).UnixNano()
+		require.NoError(t, calc.ProcessEvent(event))
+	}
+	time.Sleep(shortWait)
+	stop()
+
+	// The history is journaled rather than snapshotted
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var snapshot proto.CalculatorSnapshot
+	require.NoError(t, protobuf.Unmarshal(data, &snapshot))
+	require.Len(t, snapshot.Series, 1)
+	assert.Empty(t, snapshot.Series[0].History)
+
+	restored := NewMetricsCalculatorWithConfig(config)
+	stop = runCalculator(t, restored)
+	defer stop()
+
+	all := restored.GetAllMetrics()
+	require.Len(t, all, 1)
+	history, err := restored.History(all[0].SeriesId, base, base.Add(time.Hour), time.Hour)
+	require.NoError(t, err)
+	require.Len(t, history.Buckets, 1)
+	assert.Equal(t, int64(9), history.Buckets[0].Count)
+	assert.InEpsilon(t, 10000.0, history.Buckets[0].P90, SketchAccuracy)
+
+	// The minute level is checkpointed by default
+	history, err = restored.History(all[0].SeriesId, base, base.Add(time.Hour), time.Minute)
+	require.NoError(t, err)
+	require.Len(t, history.Buckets, 2)
+	assert.Equal(t, int64(5), history.Buckets[0].Count)
+	assert.Equal(t, int64(4), history.Buckets[1].Count)
+
+	// The second level starts over
+	history, err = restored.History(all[0].SeriesId, base, base.Add(time.Hour), time.Second)
+	require.NoError(t, err)
+	assert.Empty(t, history.Buckets)
+}
@@ -0,0 +1,74 @@
+package calculator
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+// targetState holds the per-target bookkeeping that spans its series
+type targetState struct {
+	duplicates int64 // Accessed atomically
+	clock      clockEstimator
+}
+
+// target returns the state of a target, creating it on first use
+func (c *MetricsCalculator) target(targetID string) *targetState {
+	c.targetsMu.RLock()
+	t, exists := c.targets[targetID]
+	c.targetsMu.RUnlock()
+	if exists {
+		return t
+	}
+
+	c.targetsMu.Lock()
+	defer c.targetsMu.Unlock()
+	if t, exists = c.targets[targetID]; !exists {
+		t = &targetState{}
+		c.targets[targetID] = t
+	}
+	return t
+}
+
+func (t *targetState) stats(targetID string) *proto.TargetStats {
+	stats := &proto.TargetStats{
+		TargetId:   targetID,
+		Duplicates: atomic.LoadInt64(&t.duplicates),
+	}
+	t.clock.stats(stats)
+	return stats
+}
+
+// restore loads persisted counters
+func (t *targetState) restore(stats *proto.TargetStats) {
+	atomic.StoreInt64(&t.duplicates, stats.Duplicates)
+	t.clock.restore(stats)
+}
+
+// TargetStats returns the per-target counters, sorted by target ID
+func (c *MetricsCalculator) TargetStats() []*proto.TargetStats {
+	c.targetsMu.RLock()
+	defer c.targetsMu.RUnlock()
+
+	stats := make([]*proto.TargetStats, 0, len(c.targets))
+	for targetID, t := range c.targets {
+		stats = append(stats, t.stats(targetID))
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].TargetId < stats[j].TargetId })
+	return stats
+}
+
+// isDuplicate reports whether an event repeats an event ID already seen for
+// its target, counting it if so. Events without an ID are never duplicates.
+func (c *MetricsCalculator) isDuplicate(event *proto.Event) bool {
+	if c.dedup == nil || event.EventId == "" {
+		return false
+	}
+	if !c.dedup.isDuplicate(event.TargetId+"\x00"+event.EventId, time.Now()) {
+		return false
+	}
+	atomic.AddInt64(&c.target(event.TargetId).duplicates, 1)
+	return true
+}
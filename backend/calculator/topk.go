@@ -0,0 +1,328 @@
+package calculator
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+const (
+	// MaxTopK bounds the size of a Top-K view
+	MaxTopK = 1000
+
+	// RecentRateWindow is the time constant of the decaying event rate the
+	// RATE statistic ranks by, so series that went quiet drop out of views
+	RecentRateWindow = time.Minute
+)
+
+var ErrInvalidTopK = errors.New("invalid top-k view")
+
+// topKValue reads the value a view ranks by
+func topKValue(statistic proto.TopKStatistic, m *Metrics) float64 {
+	switch statistic {
+	case proto.TopKStatistic_TOP_K_STATISTIC_MAX:
+		return m.Max()
+	case proto.TopKStatistic_TOP_K_STATISTIC_RATE:
+		return m.recentRank()
+	default:
+		return m.P90()
+	}
+}
+
+// topKEntryValue is the value of a member as sent to subscribers. Recent
+// rates keep decaying between events, so they are read when sent.
+func topKEntryValue(statistic proto.TopKStatistic, m *Metrics, value float64) float64 {
+	if statistic == proto.TopKStatistic_TOP_K_STATISTIC_RATE {
+		return m.RecentRate(time.Now())
+	}
+	return value
+}
+
+// recordArrival counts an event of the given sample weight received at
+// receivedAt towards the recent rate
+func (m *Metrics) recordArrival(receivedAt time.Time, weight float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := receivedAt.UnixNano()
+	if now < m.recentTime {
+		// Received out of order; it has decayed as much as the newer events
+		weight *= math.Exp(-float64(m.recentTime-now) / float64(RecentRateWindow))
+	} else {
+		m.recentCount *= math.Exp(-float64(now-m.recentTime) / float64(RecentRateWindow))
+		m.recentTime = now
+	}
+	m.recentCount += weight
+}
+
+// RecentRate returns the extrapolated events per second received over about
+// the last RecentRateWindow, as of now (thread-safe)
+func (m *Metrics) RecentRate(now time.Time) float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	decay := math.Exp(-float64(now.UnixNano()-m.recentTime) / float64(RecentRateWindow))
+	return m.recentCount * decay / RecentRateWindow.Seconds()
+}
+
+// recentRank orders series by their RecentRate at any common time. All rates
+// decay alike, so the order only changes when a series receives an event.
+func (m *Metrics) recentRank() float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.recentCount <= 0 {
+		return math.Inf(-1)
+	}
+	return math.Log(m.recentCount) + float64(m.recentTime)/float64(RecentRateWindow)
+}
+
+type topKKey struct {
+	statistic proto.TopKStatistic
+	k         int
+}
+
+type topKMember struct {
+	id    string
+	value float64
+}
+
+// topKView ranks all series by one statistic and keeps the K highest. The
+// other series wait in a heap, so a change to any series moves at most one
+// series in or out of the view.
+type topKView struct {
+	topKKey
+	series      map[string]*Metrics // Every ranked series by ID
+	members     []topKMember        // Highest first
+	outsiders   topKHeap            // Every other series
+	subscribers map[chan *proto.TopKUpdate]struct{}
+}
+
+func newTopKView(key topKKey) *topKView {
+	return &topKView{
+		topKKey:     key,
+		series:      make(map[string]*Metrics),
+		outsiders:   topKHeap{index: make(map[string]int)},
+		subscribers: make(map[chan *proto.TopKUpdate]struct{}),
+	}
+}
+
+// ranksBefore orders members by value, then by ID so ties are stable
+func ranksBefore(a, b topKMember) bool {
+	if a.value != b.value {
+		return a.value > b.value
+	}
+	return a.id < b.id
+}
+
+// update records the value of a series and re-ranks it
+func (v *topKView) update(m *Metrics, value float64) {
+	id := m.id
+	v.series[id] = m
+	entry := topKMember{id: id, value: value}
+
+	if i := slices.IndexFunc(v.members, func(member topKMember) bool { return member.id == id }); i >= 0 {
+		v.members[i] = entry
+		// A member that dropped may now rank below the best outsider
+		if v.outsiders.Len() > 0 && ranksBefore(v.outsiders.items[0], entry) {
+			v.members[i] = heap.Pop(&v.outsiders).(topKMember)
+			heap.Push(&v.outsiders, entry)
+		}
+	} else {
+		v.outsiders.remove(id)
+		switch {
+		case len(v.members) < v.k:
+			v.members = append(v.members, entry)
+		case ranksBefore(entry, v.members[len(v.members)-1]):
+			heap.Push(&v.outsiders, v.members[len(v.members)-1])
+			v.members[len(v.members)-1] = entry
+		default:
+			heap.Push(&v.outsiders, entry)
+			return
+		}
+	}
+	sort.Slice(v.members, func(a, b int) bool { return ranksBefore(v.members[a], v.members[b]) })
+}
+
+// rank builds the members and outsiders from the values of all series
+func (v *topKView) rank(all []topKMember) {
+	sort.Slice(all, func(a, b int) bool { return ranksBefore(all[a], all[b]) })
+	n := min(len(all), v.k)
+	v.members = all[:n:n]
+	v.outsiders.items = all[n:]
+	for i, item := range v.outsiders.items {
+		v.outsiders.index[item.id] = i
+	}
+	// Sorted highest first, the outsiders already form a heap
+}
+
+// topKHeap holds the series outside a view, highest ranked first. It is
+// indexed by series ID so a series can be taken out when its value changes.
+type topKHeap struct {
+	items []topKMember
+	index map[string]int // Position of every series in items
+}
+
+func (h *topKHeap) Len() int           { return len(h.items) }
+func (h *topKHeap) Less(a, b int) bool { return ranksBefore(h.items[a], h.items[b]) }
+
+func (h *topKHeap) Swap(a, b int) {
+	h.items[a], h.items[b] = h.items[b], h.items[a]
+	h.index[h.items[a].id] = a
+	h.index[h.items[b].id] = b
+}
+
+func (h *topKHeap) Push(x any) {
+	item := x.(topKMember)
+	h.index[item.id] = len(h.items)
+	h.items = append(h.items, item)
+}
+
+func (h *topKHeap) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	delete(h.index, item.id)
+	return item
+}
+
+// remove takes a series out of the heap, if it is there
+func (h *topKHeap) remove(id string) {
+	if i, exists := h.index[id]; exists {
+		heap.Remove(h, i)
+	}
+}
+
+func (v *topKView) ids() []string {
+	ids := make([]string, len(v.members))
+	for i, member := range v.members {
+		ids[i] = member.id
+	}
+	return ids
+}
+
+// toUpdate describes the current ranking, listing the series that entered
+// and left since previous
+func (v *topKView) toUpdate(previous []string) *proto.TopKUpdate {
+	update := &proto.TopKUpdate{
+		Statistic: v.statistic,
+		K:         int32(v.k),
+		Entries:   make([]*proto.TopKEntry, len(v.members)),
+	}
+	current := make(map[string]bool, len(v.members))
+	for i, member := range v.members {
+		m := v.series[member.id]
+		update.Entries[i] = &proto.TopKEntry{
+			SeriesId: member.id,
+			TargetId: m.TargetID,
+			Key:      m.Key,
+			Metadata: m.Metadata,
+			Value:    topKEntryValue(v.statistic, m, member.value),
+		}
+		current[member.id] = true
+		if !slices.Contains(previous, member.id) {
+			update.Entered = append(update.Entered, member.id)
+		}
+	}
+	for _, id := range previous {
+		if !current[id] {
+			update.Left = append(update.Left, id)
+		}
+	}
+	return update
+}
+
+// SubscribeTopK returns a channel receiving the ranking of the k highest
+// series by statistic, starting with the current one and then whenever the
+// ranking changes. Subscribers to the same statistic and k share a view.
+func (c *MetricsCalculator) SubscribeTopK(statistic proto.TopKStatistic, k int) (chan *proto.TopKUpdate, error) {
+	if _, ok := proto.TopKStatistic_name[int32(statistic)]; !ok || k <= 0 || k > MaxTopK {
+		return nil, ErrInvalidTopK
+	}
+
+	c.topKMu.Lock()
+	defer c.topKMu.Unlock()
+
+	key := topKKey{statistic: statistic, k: k}
+	view, exists := c.topKViews[key]
+	if !exists {
+		view = newTopKView(key)
+		var all []topKMember
+		c.metricsMu.RLock()
+		for _, m := range c.metrics {
+			if m.hasIntervals() {
+				all = append(all, topKMember{id: m.id, value: topKValue(statistic, m)})
+				view.series[m.id] = m
+			}
+		}
+		c.metricsMu.RUnlock()
+		view.rank(all)
+		c.topKViews[key] = view
+	}
+
+	ch := make(chan *proto.TopKUpdate, 100)
+	ch <- view.toUpdate(nil)
+	view.subscribers[ch] = struct{}{}
+	return ch, nil
+}
+
+// UnsubscribeTopK closes a channel returned by SubscribeTopK, dropping its
+// view once nobody else follows it
+func (c *MetricsCalculator) UnsubscribeTopK(ch chan *proto.TopKUpdate) {
+	c.topKMu.Lock()
+	defer c.topKMu.Unlock()
+
+	for key, view := range c.topKViews {
+		if _, exists := view.subscribers[ch]; !exists {
+			continue
+		}
+		delete(view.subscribers, ch)
+		close(ch)
+		if len(view.subscribers) == 0 {
+			delete(c.topKViews, key)
+		}
+		return
+	}
+}
+
+// updateTopK re-ranks a series in every view and notifies the subscribers of
+// the views whose ranking changed
+func (c *MetricsCalculator) updateTopK(m *Metrics) {
+	if !m.hasIntervals() {
+		return
+	}
+
+	c.topKMu.Lock()
+	defer c.topKMu.Unlock()
+
+	for _, view := range c.topKViews {
+		before := view.ids()
+		view.update(m, topKValue(view.statistic, m))
+		if slices.Equal(before, view.ids()) {
+			continue
+		}
+		update := view.toUpdate(before)
+		for ch := range view.subscribers {
+			select {
+			case ch <- update:
+			default:
+				// Drop update if subscriber's channel is full to prevent blocking
+			}
+		}
+	}
+}
+
+// closeTopKSubscribers closes every Top-K channel and drops all views
+func (c *MetricsCalculator) closeTopKSubscribers() {
+	c.topKMu.Lock()
+	defer c.topKMu.Unlock()
+
+	for _, view := range c.topKViews {
+		for ch := range view.subscribers {
+			close(ch)
+		}
+	}
+	c.topKViews = make(map[topKKey]*topKView)
+}
@@ -0,0 +1,169 @@
+package calculator
+
+import (
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopKViewUpdate(t *testing.T) {
+	v := newTopKView(topKKey{k: 2})
+	series := func(id string) *Metrics { return &Metrics{TargetID: "t", Key: id, id: id} }
+	a, b, c := series("a"), series("b"), series("c")
+
+	v.update(a, 10)
+	v.update(b, 20)
+	v.update(c, 5)
+	assert.Equal(t, []string{"b", "a"}, v.ids(), "c ranks below the view")
+
+	v.update(c, 30)
+	assert.Equal(t, []string{"c", "b"}, v.ids(), "c overtakes a")
+
+	// When a member drops, the best outsider takes its place
+	v.update(b, 1)
+	assert.Equal(t, []string{"c", "a"}, v.ids())
+
+	update := v.toUpdate([]string{"c", "b"})
+	require.Len(t, update.Entries, 2)
+	assert.Equal(t, "c", update.Entries[0].SeriesId)
+	assert.Equal(t, 30.0, update.Entries[0].Value)
+	assert.Equal(t, []string{"a"}, update.Entered)
+	assert.Equal(t, []string{"b"}, update.Left)
+}
+
+func TestTopKViewMatchesFullRank(t *testing.T) {
+	v := newTopKView(topKKey{k: 5})
+	rng := rand.New(rand.NewPCG(1, 2))
+	values := make(map[string]float64)
+	for range 2000 {
+		id := strconv.Itoa(rng.IntN(20))
+		value := float64(rng.IntN(50))
+		values[id] = value
+		v.update(&Metrics{id: id}, value)
+
+		all := make([]topKMember, 0, len(values))
+		for id, value := range values {
+			all = append(all, topKMember{id: id, value: value})
+		}
+		sort.Slice(all, func(a, b int) bool { return ranksBefore(all[a], all[b]) })
+		want := make([]string, 0, v.k)
+		for _, member := range all[:min(len(all), v.k)] {
+			want = append(want, member.id)
+		}
+		require.Equal(t, want, v.ids())
+	}
+}
+
+func TestTopKRecentRate(t *testing.T) {
+	base := time.Now()
+	burst, steady := &Metrics{id: "burst"}, &Metrics{id: "steady"}
+
+	// A burst of a thousand events, then silence
+	for i := range 1000 {
+		burst.recordArrival(base.Add(time.Duration(i)*time.Millisecond), 1)
+	}
+	// Ten events a second for ten minutes
+	for i := range 6000 {
+		steady.recordArrival(base.Add(time.Duration(i)*100*time.Millisecond), 1)
+	}
+	now := base.Add(10 * time.Minute)
+	assert.InEpsilon(t, 10.0, steady.RecentRate(now), 0.01)
+	assert.Less(t, burst.RecentRate(now), 0.01)
+
+	// The lifetime rate of the burst is far higher, but it went quiet
+	v := newTopKView(topKKey{statistic: proto.TopKStatistic_TOP_K_STATISTIC_RATE, k: 1})
+	v.update(burst, topKValue(v.statistic, burst))
+	v.update(steady, topKValue(v.statistic, steady))
+	assert.Equal(t, []string{"steady"}, v.ids())
+
+	// Weighted events stand for as many events
+	sampled := &Metrics{id: "sampled"}
+	for i := range 600 {
+		sampled.recordArrival(base.Add(time.Duration(i)*time.Second), 10)
+	}
+	assert.InEpsilon(t, 10.0, sampled.RecentRate(base.Add(10*time.Minute)), 0.01)
+}
+
+func TestTopKViewTies(t *testing.T) {
+	v := newTopKView(topKKey{k: 1})
+	v.update(&Metrics{id: "b"}, 10)
+	v.update(&Metrics{id: "a"}, 10)
+	assert.Equal(t, []string{"a"}, v.ids(), "Ties rank by series ID")
+}
+
+func TestSubscribeTopKValidation(t *testing.T) {
+	calc := NewMetricsCalculator()
+	_, err := calc.SubscribeTopK(proto.TopKStatistic_TOP_K_STATISTIC_P90, 0)
+	assert.ErrorIs(t, err, ErrInvalidTopK)
+	_, err = calc.SubscribeTopK(proto.TopKStatistic_TOP_K_STATISTIC_P90, MaxTopK+1)
+	assert.ErrorIs(t, err, ErrInvalidTopK)
+	_, err = calc.SubscribeTopK(proto.TopKStatistic(42), 5)
+	assert.ErrorIs(t, err, ErrInvalidTopK)
+}
+
+func TestSubscribeTopK(t *testing.T) {
+	calc := NewMetricsCalculator()
+	stop := runCalculator(t, calc)
+	defer stop()
+
+	base := time.Now()
+	send := func(key string, offsets ...time.Duration) {
+		for _, offset := range offsets {
+			event := createTestEvent(testTargetID, key, nil)
+			event.ServerTimestamp = base.Add(offset).UnixNano()
+			require.NoError(t, calc.ProcessEvent(event))
+		}
+	}
+	send("fast", 0, 10*time.Millisecond)
+	send("slow", 0, 100*time.Millisecond)
+	time.Sleep(shortWait)
+
+	ch, err := calc.SubscribeTopK(proto.TopKStatistic_TOP_K_STATISTIC_MAX, 1)
+	require.NoError(t, err)
+	defer calc.UnsubscribeTopK(ch)
+
+	initial := <-ch
+	require.Len(t, initial.Entries, 1)
+	assert.Equal(t, "slow", initial.Entries[0].Key)
+	assert.Equal(t, 100.0, initial.Entries[0].Value)
+
+	// "fast" becomes the slowest series and takes over the view
+	send("fast", 500*time.Millisecond)
+	select {
+	case update := <-ch:
+		require.Len(t, update.Entries, 1)
+		assert.Equal(t, "fast", update.Entries[0].Key)
+		assert.Equal(t, []string{update.Entries[0].SeriesId}, update.Entered)
+		assert.Equal(t, []string{initial.Entries[0].SeriesId}, update.Left)
+	case <-time.After(time.Second):
+		t.Fatal("No ranking change received")
+	}
+
+	// A new max within the same ranking sends nothing
+	send("fast", 1000*time.Millisecond)
+	select {
+	case update := <-ch:
+		t.Fatalf("Unexpected update %v", update)
+	case <-time.After(shortWait):
+	}
+}
+
+func TestUnsubscribeTopKDropsView(t *testing.T) {
+	calc := NewMetricsCalculator()
+	first, err := calc.SubscribeTopK(proto.TopKStatistic_TOP_K_STATISTIC_RATE, 3)
+	require.NoError(t, err)
+	second, err := calc.SubscribeTopK(proto.TopKStatistic_TOP_K_STATISTIC_RATE, 3)
+	require.NoError(t, err)
+	assert.Len(t, calc.topKViews, 1, "Equal views are shared")
+
+	calc.UnsubscribeTopK(first)
+	assert.Len(t, calc.topKViews, 1)
+	calc.UnsubscribeTopK(second)
+	assert.Empty(t, calc.topKViews)
+}
@@ -3,15 +3,21 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/elodin/latency-dash/backend/calculator"
 	"github.com/elodin/latency-dash/backend/generator"
+	"github.com/elodin/latency-dash/backend/ingest"
+	"github.com/elodin/latency-dash/backend/prober"
+	"github.com/elodin/latency-dash/backend/proto"
 	"github.com/elodin/latency-dash/backend/server"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -20,14 +26,52 @@ const (
 )
 
 func main() {
-	// Initialize the metrics calculator
-	metricsCalculator := calculator.NewMetricsCalculator()
+	// Initialize the metrics calculator, checkpointing to SNAPSHOT_PATH and
+	// capturing events to CAPTURE_DIR on request if set
+	metricsCalculator := calculator.NewMetricsCalculatorWithConfig(calculator.Config{
+		SnapshotPath: os.Getenv("SNAPSHOT_PATH"),
+		CaptureDir:   os.Getenv("CAPTURE_DIR"),
+		DedupWindow:  5 * time.Minute,
+		// Producers deliver their freshest event within a second of taking
+		// it, even when batching, so a second of disagreement with the
+		// estimated clock offset beyond that is a clock step
+		ClockStepThreshold: 1 * time.Second,
+		Comparisons: []calculator.ComparisonConfig{
+			{
+				Name:    "us-east-vs-eu-west",
+				Targets: []string{"prod-us-east", "prod-eu-west"},
+			},
+		},
+	})
 
 	// Start the WebSocket server
 	wsServer := server.NewWebSocketServer(metricsCalculator)
 
+	// Start the HTTP API server
+	apiServer := server.NewAPIServer(metricsCalculator)
+
+	// Turn OTLP spans into latency samples, keeping the attributes listed in
+	// OTLP_RESOURCE_ATTRIBUTES and OTLP_SPAN_ATTRIBUTES (comma-separated)
+	otlpReceiver := server.NewOTLPReceiver(metricsCalculator, server.OTLPConfig{
+		ResourceAttributes: splitList(os.Getenv("OTLP_RESOURCE_ATTRIBUTES")),
+		SpanAttributes:     splitList(os.Getenv("OTLP_SPAN_ATTRIBUTES")),
+	})
+
 	// Set up HTTP routes
 	http.HandleFunc("/ws", wsServer.HandleWebSocket)
+	http.HandleFunc("GET /api/series/{id}/history", apiServer.HandleSeriesHistory)
+	http.HandleFunc("GET /api/series/{id}/heatmap", apiServer.HandleSeriesHeatmap)
+	http.HandleFunc("GET /api/targets", apiServer.HandleTargets)
+	http.HandleFunc("GET /api/discovery", apiServer.HandleDiscovery)
+	http.HandleFunc("POST /api/events", apiServer.HandleEvents)
+	http.HandleFunc("POST /v1/traces", otlpReceiver.HandleTraces)
+	http.HandleFunc("POST /api/baselines", apiServer.HandleCreateBaseline)
+	http.HandleFunc("GET /api/baselines", apiServer.HandleBaselines)
+	http.HandleFunc("GET /api/baselines/{name}", apiServer.HandleBaseline)
+	http.HandleFunc("DELETE /api/baselines/{name}", apiServer.HandleDeleteBaseline)
+	http.HandleFunc("GET /api/capture", apiServer.HandleCapture)
+	http.HandleFunc("POST /api/capture", apiServer.HandleStartCapture)
+	http.HandleFunc("DELETE /api/capture", apiServer.HandleStopCapture)
 	http.Handle("/", http.FileServer(http.Dir("../../frontend/dist")))
 
 	// Start the HTTP server
@@ -43,6 +87,26 @@ func main() {
 		}
 	}()
 
+	// Start the gRPC ingestion server alongside the HTTP server
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = "9090"
+	}
+	grpcServer := grpc.NewServer()
+	proto.RegisterIngestServer(grpcServer, server.NewIngestServer(metricsCalculator))
+	defer grpcServer.Stop()
+
+	go func() {
+		listener, err := net.Listen("tcp", ":"+grpcPort)
+		if err != nil {
+			log.Fatalf("Failed to listen for gRPC: %v", err)
+		}
+		log.Printf("gRPC server starting on :%s...\n", grpcPort)
+		if err := grpcServer.Serve(listener); err != nil {
+			log.Fatalf("Failed to start gRPC server: %v", err)
+		}
+	}()
+
 	// Start the metrics calculator
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -60,15 +124,66 @@ func main() {
 		log.Println("Metrics calculator started successfully")
 	}
 	defer func() {
-		metricsCalculator.Stop()
+		metricsCalculator.Close()
 		if err := <-errChan; err != nil {
 			log.Printf("Metric calculator returned unexpected error: %v", err)
 		}
 	}()
 
+	// Receive StatsD timers over UDP if STATSD_ADDR is set, e.g. ":8125"
+	if addr := os.Getenv("STATSD_ADDR"); addr != "" {
+		statsd, err := ingest.ListenStatsD(ingest.StatsDConfig{Addr: addr}, metricsCalculator)
+		if err != nil {
+			log.Fatalf("Failed to listen for StatsD: %v", err)
+		}
+		log.Printf("StatsD listener starting on %s...\n", statsd.Addr())
+		go statsd.Serve(ctx)
+		defer func() {
+			log.Printf("StatsD listener received %s", statsd.Stats())
+		}()
+	}
+
+	// Read newline-delimited JSON events over TCP and a Unix socket if
+	// NDJSON_ADDR and NDJSON_SOCKET are set
+	for network, addr := range map[string]string{"tcp": os.Getenv("NDJSON_ADDR"), "unix": os.Getenv("NDJSON_SOCKET")} {
+		if addr == "" {
+			continue
+		}
+		ndjson, err := ingest.ListenNDJSON(ingest.NDJSONConfig{Network: network, Addr: addr}, metricsCalculator)
+		if err != nil {
+			log.Fatalf("Failed to listen for NDJSON: %v", err)
+		}
+		log.Printf("NDJSON listener starting on %s %s...\n", network, ndjson.Addr())
+		go ndjson.Serve(ctx)
+		defer func() {
+			log.Printf("NDJSON listener on %s received %s", network, ndjson.Stats())
+		}()
+	}
+
+	// Follow log files if LOG_TAIL_PATHS (comma-separated) and
+	// LOG_TAIL_PATTERN, a regexp with named groups, are set
+	if paths, pattern := os.Getenv("LOG_TAIL_PATHS"), os.Getenv("LOG_TAIL_PATTERN"); paths != "" && pattern != "" {
+		tailer, err := ingest.NewTailer(ingest.TailConfig{
+			Paths:    splitList(paths),
+			Patterns: []ingest.TailPattern{{Regexp: pattern, TargetID: "logs"}},
+		}, metricsCalculator)
+		if err != nil {
+			log.Fatalf("Failed to configure log tailing: %v", err)
+		}
+		log.Printf("Tailing %s...\n", paths)
+		go tailer.Serve(ctx)
+		defer func() {
+			log.Printf("Log tailer read %s", tailer.Stats())
+		}()
+	}
+
 	// Start test event generators
 	startTestGenerators(metricsCalculator)
 
+	// Start probers for the addresses in PROBE_HTTP_URLS, PROBE_TCP_ADDRS and
+	// PROBE_DNS_NAMES (comma-separated)
+	startProbers(metricsCalculator)
+
 	// Wait for interrupt signal to gracefully shut down
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -82,6 +197,14 @@ func main() {
 	}
 }
 
+// splitList splits a comma-separated environment variable
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
 func startTestGenerators(calculator *calculator.MetricsCalculator) {
 	// Define metadata rules for different tiers and regions
 	metadataRules := map[string]map[string]float64{
@@ -142,3 +265,36 @@ func startTestGenerators(calculator *calculator.MetricsCalculator) {
 		}(gen)
 	}
 }
+
+func startProbers(calculator *calculator.MetricsCalculator) {
+	var configs []prober.Config
+	for kind, addresses := range map[prober.Kind]string{
+		prober.KindHTTP: os.Getenv("PROBE_HTTP_URLS"),
+		prober.KindTCP:  os.Getenv("PROBE_TCP_ADDRS"),
+		prober.KindDNS:  os.Getenv("PROBE_DNS_NAMES"),
+	} {
+		for _, address := range splitList(addresses) {
+			configs = append(configs, prober.Config{
+				TargetID: "probes",
+				Kind:     kind,
+				Address:  address,
+				Interval: 10 * time.Second,
+			})
+		}
+	}
+
+	for _, cfg := range configs {
+		p, err := prober.NewProber(cfg)
+		if err != nil {
+			log.Fatalf("Failed to configure %s prober for %s: %v", cfg.Kind, cfg.Address, err)
+		}
+		p.Start()
+
+		// Forward events to the metrics calculator
+		go func(p *prober.Prober) {
+			for event := range p.Events() {
+				calculator.ProcessEvent(event)
+			}
+		}(p)
+	}
+}
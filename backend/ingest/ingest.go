@@ -0,0 +1,13 @@
+// Package ingest receives events from external producers over protocols
+// other than the HTTP, WebSocket and gRPC APIs of the server package.
+package ingest
+
+import (
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+// Sink receives the events of a source; a *calculator.MetricsCalculator is
+// one
+type Sink interface {
+	ProcessEvent(event *proto.Event) error
+}
@@ -0,0 +1,262 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/calculator"
+	"github.com/elodin/latency-dash/backend/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// DefaultNDJSONLineSize is the longest line read
+	DefaultNDJSONLineSize = 1 << 20
+
+	// ndjsonWriteTimeout bounds how long reporting an error to a client that
+	// doesn't read may take
+	ndjsonWriteTimeout = 5 * time.Second
+)
+
+var ErrLineTooLong = errors.New("line too long")
+
+// NDJSONConfig configures an NDJSONListener
+type NDJSONConfig struct {
+	// Network is "tcp" or "unix"
+	Network string
+	// Addr is the TCP address or socket path to listen on. A stale socket
+	// left behind at the path is replaced.
+	Addr string
+	// MaxLineSize bounds a line; longer lines are rejected. Defaults to
+	// DefaultNDJSONLineSize.
+	MaxLineSize int
+}
+
+// NDJSONStats counts what an NDJSONListener received
+type NDJSONStats struct {
+	Connections   uint64 // Connections accepted
+	Events        uint64 // Events the sink accepted
+	DroppedEvents uint64 // Valid events the sink rejected
+	InvalidLines  uint64 // Lines that aren't valid events
+}
+
+// NDJSONListener reads newline-delimited protojson Events from stream
+// connections. A line split across writes is put back together; a final
+// line without a newline is read when the client closes its side. Every
+// rejected line is reported back on its connection as a protojson
+// IngestError, indexed by the position of the line on the connection, so
+// clients can tell which events were lost. Blank lines are skipped.
+type NDJSONListener struct {
+	config   NDJSONConfig
+	sink     Sink
+	listener net.Listener
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+
+	connections   atomic.Uint64
+	events        atomic.Uint64
+	droppedEvents atomic.Uint64
+	invalidLines  atomic.Uint64
+}
+
+// ListenNDJSON binds the address of config. Connections are accepted once
+// Serve is called.
+func ListenNDJSON(config NDJSONConfig, sink Sink) (*NDJSONListener, error) {
+	if config.MaxLineSize <= 0 {
+		config.MaxLineSize = DefaultNDJSONLineSize
+	}
+	if config.Network == "unix" {
+		removeStaleSocket(config.Addr)
+	}
+
+	listener, err := net.Listen(config.Network, config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &NDJSONListener{
+		config:   config,
+		sink:     sink,
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// removeStaleSocket removes a socket nobody listens on anymore
+func removeStaleSocket(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		// Still in use; let Listen report it
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+// Addr returns the address the listener is bound to
+func (l *NDJSONListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Stats returns the counters of the listener
+func (l *NDJSONListener) Stats() NDJSONStats {
+	return NDJSONStats{
+		Connections:   l.connections.Load(),
+		Events:        l.events.Load(),
+		DroppedEvents: l.droppedEvents.Load(),
+		InvalidLines:  l.invalidLines.Load(),
+	}
+}
+
+// Close stops the listener and closes its connections
+func (l *NDJSONListener) Close() error {
+	err := l.listener.Close()
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// Serve accepts connections until the context is canceled or the listener
+// closed, then waits for the connections to finish
+func (l *NDJSONListener) Serve(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		l.connsMu.Lock()
+		l.conns[conn] = struct{}{}
+		l.connsMu.Unlock()
+		l.connections.Add(1)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.handleConn(conn)
+
+			l.connsMu.Lock()
+			delete(l.conns, conn)
+			l.connsMu.Unlock()
+		}()
+	}
+}
+
+// handleConn reads events from a connection until the client is done
+func (l *NDJSONListener) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, l.config.MaxLineSize)
+	for index := int32(0); ; index++ {
+		line, err := readLine(reader)
+		if errors.Is(err, ErrLineTooLong) {
+			l.invalidLines.Add(1)
+			if !l.report(conn, index, fmt.Errorf("%w: longer than %d bytes", ErrLineTooLong, l.config.MaxLineSize)) {
+				return
+			}
+			continue
+		}
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if lineErr := l.handleLine(line); lineErr != nil && !l.report(conn, index, lineErr) {
+				return
+			}
+		}
+
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error reading NDJSON from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// readLine reads up to and including the next newline. A line longer than
+// the reader's buffer is skipped and reported as ErrLineTooLong. At the end
+// of the stream the final line is returned along with io.EOF.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadSlice('\n')
+	if !errors.Is(err, bufio.ErrBufferFull) {
+		return line, err
+	}
+	for errors.Is(err, bufio.ErrBufferFull) {
+		_, err = reader.ReadSlice('\n')
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return nil, ErrLineTooLong
+}
+
+// handleLine sends the event on a line to the sink
+func (l *NDJSONListener) handleLine(line []byte) error {
+	var event proto.Event
+	err := protojson.Unmarshal(line, &event)
+	if err == nil {
+		err = calculator.ValidateEvent(&event)
+	}
+	if err != nil {
+		l.invalidLines.Add(1)
+		return err
+	}
+
+	if err := l.sink.ProcessEvent(&event); err != nil {
+		l.droppedEvents.Add(1)
+		return err
+	}
+	l.events.Add(1)
+	return nil
+}
+
+// report tells the client why a line was rejected. It returns false if the
+// client can't be written to.
+func (l *NDJSONListener) report(conn net.Conn, index int32, err error) bool {
+	data, marshalErr := protojson.Marshal(&proto.IngestError{Index: index, Message: err.Error()})
+	if marshalErr != nil {
+		log.Printf("Error marshaling NDJSON error: %v", marshalErr)
+		return true
+	}
+
+	if err := conn.SetWriteDeadline(time.Now().Add(ndjsonWriteTimeout)); err != nil {
+		return false
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		log.Printf("Error reporting to NDJSON client %s: %v", conn.RemoteAddr(), err)
+		return false
+	}
+	return true
+}
+
+// String summarizes the counters for logs
+func (s NDJSONStats) String() string {
+	return fmt.Sprintf("%d connections, %d events (%d dropped), %d invalid lines",
+		s.Connections, s.Events, s.DroppedEvents, s.InvalidLines)
+}
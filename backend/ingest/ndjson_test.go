@@ -0,0 +1,118 @@
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// serveNDJSON runs a listener until the test ends
+func serveNDJSON(t *testing.T, config NDJSONConfig, sink Sink) *NDJSONListener {
+	t.Helper()
+	listener, err := ListenNDJSON(config, sink)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- listener.Serve(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		assert.ErrorIs(t, <-errChan, context.Canceled)
+	})
+	return listener
+}
+
+// sendNDJSON writes chunks to the listener, closes the sending side and
+// returns the errors reported back
+func sendNDJSON(t *testing.T, listener *NDJSONListener, chunks ...string) []*proto.IngestError {
+	t.Helper()
+	conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for _, chunk := range chunks {
+		_, err := conn.Write([]byte(chunk))
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		require.NoError(t, c.CloseWrite())
+	case *net.UnixConn:
+		require.NoError(t, c.CloseWrite())
+	}
+
+	var errors []*proto.IngestError
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var ingestErr proto.IngestError
+		require.NoError(t, protojson.Unmarshal(scanner.Bytes(), &ingestErr))
+		errors = append(errors, &ingestErr)
+	}
+	require.NoError(t, scanner.Err())
+	return errors
+}
+
+func eventLine(key string, ts time.Time) string {
+	return `{"targetId": "sidecar", "key": "` + key + `", "serverTimestamp": "` + strconv.FormatInt(ts.UnixNano(), 10) + `"}`
+}
+
+func TestNDJSONListenerTCP(t *testing.T) {
+	sink := &recordingSink{}
+	listener := serveNDJSON(t, NDJSONConfig{Network: "tcp", Addr: "127.0.0.1:0", MaxLineSize: 256}, sink)
+	base := time.Now()
+
+	first := eventLine("backup", base)
+	errors := sendNDJSON(t, listener,
+		// A line split across writes
+		first[:20], first[20:]+"\n",
+		"\n",
+		"not json\n",
+		`{"targetId": "sidecar"}`+"\n",
+		`{"targetId": "sidecar", "key": "`+strings.Repeat("x", 300)+`"}`+"\n",
+		// The final line has no newline
+		eventLine("backup", base.Add(time.Second)),
+	)
+
+	require.Len(t, errors, 3)
+	assert.Equal(t, int32(2), errors[0].Index)
+	assert.Equal(t, int32(3), errors[1].Index)
+	assert.Contains(t, errors[1].Message, "missing key")
+	assert.Equal(t, int32(4), errors[2].Index)
+	assert.Contains(t, errors[2].Message, ErrLineTooLong.Error())
+
+	events := sink.Events()
+	require.Len(t, events, 2)
+	assert.Equal(t, "backup", events[1].Key)
+	assert.Equal(t, base.Add(time.Second).UnixNano(), events[1].ServerTimestamp)
+	assert.Equal(t, NDJSONStats{Connections: 1, Events: 2, InvalidLines: 3}, listener.Stats())
+}
+
+func TestNDJSONListenerUnix(t *testing.T) {
+	sink := &recordingSink{capacity: 1}
+	path := filepath.Join(t.TempDir(), "ingest.sock")
+	listener := serveNDJSON(t, NDJSONConfig{Network: "unix", Addr: path}, sink)
+	base := time.Now()
+
+	errors := sendNDJSON(t, listener,
+		eventLine("sync", base)+"\n"+eventLine("sync", base.Add(time.Second))+"\n",
+	)
+	require.Len(t, errors, 1)
+	assert.Equal(t, int32(1), errors[0].Index)
+	assert.Contains(t, errors[0].Message, "sink full")
+	assert.Len(t, sink.Events(), 1)
+	assert.Equal(t, NDJSONStats{Connections: 1, Events: 1, DroppedEvents: 1}, listener.Stats())
+}
@@ -0,0 +1,266 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+const (
+	// DefaultStatsDTargetTag is the tag naming the target of a timer
+	DefaultStatsDTargetTag = "target"
+	// DefaultStatsDTarget is the target of timers without a target tag
+	DefaultStatsDTarget = "statsd"
+	// DefaultStatsDPacketSize is the largest packet read, matching the
+	// default buffer of DogStatsD clients
+	DefaultStatsDPacketSize = 8192
+)
+
+var (
+	ErrMalformedLine = errors.New("malformed statsd line")
+
+	// errUnsupportedType marks well-formed lines of metrics other than timers
+	errUnsupportedType = errors.New("unsupported statsd metric type")
+)
+
+// StatsDConfig configures a StatsDListener
+type StatsDConfig struct {
+	// Addr is the UDP address to listen on, e.g. ":8125"
+	Addr string
+	// TargetTag is the tag naming the target of a timer. Defaults to
+	// DefaultStatsDTargetTag.
+	TargetTag string
+	// TargetID is the target of timers without a target tag. Defaults to
+	// DefaultStatsDTarget.
+	TargetID string
+	// MaxPacketSize bounds the packets read; larger packets are dropped.
+	// Defaults to DefaultStatsDPacketSize.
+	MaxPacketSize int
+}
+
+// StatsDStats counts what a StatsDListener received
+type StatsDStats struct {
+	Packets        uint64 // Packets read
+	DroppedPackets uint64 // Packets larger than MaxPacketSize
+	Events         uint64 // Timer samples the sink accepted
+	DroppedEvents  uint64 // Timer samples the sink rejected
+	MalformedLines uint64 // Lines that couldn't be parsed
+	IgnoredLines   uint64 // Lines of metrics other than timers
+}
+
+// StatsDListener turns StatsD timers received over UDP into events. Lines
+// follow the DogStatsD format:
+//
+//	<name>:<value>[:<value>...]|<type>[|@<sample rate>][|#<tag>:<value>,...][|T<unix seconds>]
+//
+// Timers (ms), histograms (h) and distributions (d) become events with the
+// value as their duration in milliseconds. The name is the key, the target
+// tag the target, and the other tags the metadata. Other metric types are
+// ignored.
+type StatsDListener struct {
+	config StatsDConfig
+	sink   Sink
+	conn   net.PacketConn
+
+	packets        atomic.Uint64
+	droppedPackets atomic.Uint64
+	events         atomic.Uint64
+	droppedEvents  atomic.Uint64
+	malformedLines atomic.Uint64
+	ignoredLines   atomic.Uint64
+}
+
+// ListenStatsD binds the UDP address of config. Packets are read once Serve
+// is called.
+func ListenStatsD(config StatsDConfig, sink Sink) (*StatsDListener, error) {
+	if config.TargetTag == "" {
+		config.TargetTag = DefaultStatsDTargetTag
+	}
+	if config.TargetID == "" {
+		config.TargetID = DefaultStatsDTarget
+	}
+	if config.MaxPacketSize <= 0 {
+		config.MaxPacketSize = DefaultStatsDPacketSize
+	}
+
+	conn, err := net.ListenPacket("udp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsDListener{config: config, sink: sink, conn: conn}, nil
+}
+
+// Addr returns the address the listener is bound to
+func (l *StatsDListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Stats returns the counters of the listener
+func (l *StatsDListener) Stats() StatsDStats {
+	return StatsDStats{
+		Packets:        l.packets.Load(),
+		DroppedPackets: l.droppedPackets.Load(),
+		Events:         l.events.Load(),
+		DroppedEvents:  l.droppedEvents.Load(),
+		MalformedLines: l.malformedLines.Load(),
+		IgnoredLines:   l.ignoredLines.Load(),
+	}
+}
+
+// Close stops the listener
+func (l *StatsDListener) Close() error {
+	return l.conn.Close()
+}
+
+// Serve reads packets until the context is canceled or the listener closed
+func (l *StatsDListener) Serve(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() { l.conn.Close() })
+	defer stop()
+
+	// One spare byte tells packets that were cut short from ones that fit
+	buf := make([]byte, l.config.MaxPacketSize+1)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		l.packets.Add(1)
+		if n > l.config.MaxPacketSize {
+			l.droppedPackets.Add(1)
+			continue
+		}
+		l.handlePacket(string(buf[:n]), time.Now())
+	}
+}
+
+// handlePacket sends the timers of every line of a packet to the sink
+func (l *StatsDListener) handlePacket(packet string, now time.Time) {
+	for _, line := range strings.Split(packet, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+
+		events, err := l.parseLine(line, now)
+		if errors.Is(err, errUnsupportedType) {
+			l.ignoredLines.Add(1)
+			continue
+		}
+		if err != nil {
+			l.malformedLines.Add(1)
+			continue
+		}
+		for _, event := range events {
+			if err := l.sink.ProcessEvent(event); err != nil {
+				l.droppedEvents.Add(1)
+				continue
+			}
+			l.events.Add(1)
+		}
+	}
+}
+
+// parseLine turns a line into one event per value
+func (l *StatsDListener) parseLine(line string, now time.Time) ([]*proto.Event, error) {
+	// DogStatsD events and service checks aren't metrics
+	if strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+		return nil, errUnsupportedType
+	}
+
+	sections := strings.Split(line, "|")
+	if len(sections) < 2 {
+		return nil, fmt.Errorf("%w: missing type", ErrMalformedLine)
+	}
+	name, rawValues, found := strings.Cut(sections[0], ":")
+	if !found || name == "" || rawValues == "" {
+		return nil, fmt.Errorf("%w: expected <name>:<value>", ErrMalformedLine)
+	}
+	switch sections[1] {
+	case "ms", "h", "d":
+	case "c", "g", "s":
+		return nil, errUnsupportedType
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", ErrMalformedLine, sections[1])
+	}
+
+	targetID := l.config.TargetID
+	timestamp := now
+	var sampleRate float64
+	var metadata map[string]string
+	for _, section := range sections[2:] {
+		switch {
+		case strings.HasPrefix(section, "@"):
+			rate, err := strconv.ParseFloat(section[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("%w: invalid sample rate %q", ErrMalformedLine, section[1:])
+			}
+			sampleRate = rate
+		case strings.HasPrefix(section, "#"):
+			for _, tag := range strings.Split(section[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				tagName, value, _ := strings.Cut(tag, ":")
+				if tagName == l.config.TargetTag {
+					targetID = value
+					continue
+				}
+				if metadata == nil {
+					metadata = make(map[string]string)
+				}
+				metadata[tagName] = value
+			}
+		case strings.HasPrefix(section, "T"):
+			seconds, err := strconv.ParseInt(section[1:], 10, 64)
+			if err != nil || seconds <= 0 {
+				return nil, fmt.Errorf("%w: invalid timestamp %q", ErrMalformedLine, section[1:])
+			}
+			timestamp = time.Unix(seconds, 0)
+		default:
+			// Other DogStatsD extensions, such as container IDs, carry nothing
+			// we keep
+		}
+	}
+	if targetID == "" {
+		return nil, fmt.Errorf("%w: empty target tag", ErrMalformedLine)
+	}
+
+	var events []*proto.Event
+	for _, raw := range strings.Split(rawValues, ":") {
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil || value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("%w: invalid value %q", ErrMalformedLine, raw)
+		}
+		durationNs := int64(value * float64(time.Millisecond))
+		events = append(events, &proto.Event{
+			TargetId:        targetID,
+			Key:             name,
+			ServerTimestamp: timestamp.UnixNano(),
+			Metadata:        metadata,
+			SampleRate:      sampleRate,
+			DurationNs:      &durationNs,
+		})
+	}
+	return events, nil
+}
+
+// String summarizes the counters for logs
+func (s StatsDStats) String() string {
+	return fmt.Sprintf("%d packets (%d dropped), %d events (%d dropped), %d malformed and %d ignored lines",
+		s.Packets, s.DroppedPackets, s.Events, s.DroppedEvents, s.MalformedLines, s.IgnoredLines)
+}
@@ -0,0 +1,130 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink collects events, rejecting them once full
+type recordingSink struct {
+	mu       sync.Mutex
+	events   []*proto.Event
+	capacity int // Unlimited when zero
+}
+
+func (s *recordingSink) ProcessEvent(event *proto.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.capacity > 0 && len(s.events) >= s.capacity {
+		return errors.New("sink full")
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *recordingSink) Events() []*proto.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*proto.Event(nil), s.events...)
+}
+
+func TestStatsDParseLine(t *testing.T) {
+	listener := &StatsDListener{config: StatsDConfig{TargetTag: DefaultStatsDTargetTag, TargetID: DefaultStatsDTarget}}
+	now := time.Unix(1700000000, 0)
+
+	events, err := listener.parseLine("checkout.latency:12.5|ms|@0.5|#target:web,region:eu", now)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "web", events[0].TargetId)
+	assert.Equal(t, "checkout.latency", events[0].Key)
+	assert.Equal(t, now.UnixNano(), events[0].ServerTimestamp)
+	assert.Equal(t, 0.5, events[0].SampleRate)
+	assert.Equal(t, map[string]string{"region": "eu"}, events[0].Metadata)
+	assert.Equal(t, int64(12500*time.Microsecond), events[0].GetDurationNs())
+
+	events, err = listener.parseLine("db.query:3:4|d|T1600000000|c:container", now)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, DefaultStatsDTarget, events[0].TargetId)
+	assert.Equal(t, time.Unix(1600000000, 0).UnixNano(), events[1].ServerTimestamp)
+	assert.Equal(t, int64(4*time.Millisecond), events[1].GetDurationNs())
+
+	for _, line := range []string{"requests:1|c", "temperature:20|g", "users:42|s", "_sc|db|0"} {
+		_, err := listener.parseLine(line, now)
+		assert.ErrorIs(t, err, errUnsupportedType, line)
+	}
+
+	malformed := []string{
+		"no-type:12",
+		"no-value|ms",
+		":12|ms",
+		"negative:-1|ms",
+		"nan:NaN|ms",
+		"rate:1|ms|@2",
+		"stamp:1|ms|Tyesterday",
+		"unknown:1|x",
+		"empty-target:1|ms|#target:",
+	}
+	for _, line := range malformed {
+		_, err := listener.parseLine(line, now)
+		assert.ErrorIs(t, err, ErrMalformedLine, line)
+	}
+}
+
+func TestStatsDListener(t *testing.T) {
+	sink := &recordingSink{capacity: 3}
+	listener, err := ListenStatsD(StatsDConfig{Addr: "127.0.0.1:0", MaxPacketSize: 256}, sink)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- listener.Serve(ctx)
+	}()
+
+	conn, err := net.Dial("udp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	packets := []string{
+		"login:10|ms|#target:web\nlogin:20|ms|#target:web\r\nbroken\nhits:1|c\n",
+		"login:30|ms|#target:web\nlogin:40|ms|#target:web",
+		"oversized:1|ms|#pad:" + strings.Repeat("x", 300),
+	}
+	for _, packet := range packets {
+		_, err := conn.Write([]byte(packet))
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		return listener.Stats().Packets == 3
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, StatsDStats{
+		Packets:        3,
+		DroppedPackets: 1,
+		Events:         3,
+		DroppedEvents:  1,
+		MalformedLines: 1,
+		IgnoredLines:   1,
+	}, listener.Stats())
+
+	events := sink.Events()
+	require.Len(t, events, 3)
+	for i, event := range events {
+		assert.Equal(t, "web", event.TargetId)
+		assert.Equal(t, "login", event.Key)
+		assert.Equal(t, int64(i+1)*int64(10*time.Millisecond), event.GetDurationNs())
+	}
+
+	cancel()
+	assert.ErrorIs(t, <-errChan, context.Canceled)
+}
@@ -0,0 +1,421 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/calculator"
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+const (
+	// DefaultTailPollInterval is how often files are checked for new lines
+	DefaultTailPollInterval = 250 * time.Millisecond
+	// DefaultTailTimestampLayout parses timestamp groups
+	DefaultTailTimestampLayout = time.RFC3339Nano
+
+	// Timestamp layouts for numeric Unix times
+	TimestampUnix   = "unix"   // Seconds, possibly fractional
+	TimestampUnixMs = "unixms" // Milliseconds
+	TimestampUnixNs = "unixns" // Nanoseconds
+
+	// maxTailLine bounds a line; the rest of longer lines is skipped
+	maxTailLine = 1 << 20
+	// tailReadSize is how much of a file is read at once
+	tailReadSize = 32 << 10
+)
+
+// Named capture groups with a meaning of their own. Other named groups
+// become metadata.
+const (
+	GroupTarget    = "target"
+	GroupKey       = "key"
+	GroupTimestamp = "timestamp"
+	GroupDuration  = "duration"
+)
+
+var (
+	ErrInvalidPattern = errors.New("invalid tail pattern")
+	ErrNoMatch        = errors.New("line matches no pattern")
+)
+
+// TailPattern extracts an event from the lines it matches
+type TailPattern struct {
+	// Regexp is matched against each line. Named capture groups fill the
+	// event: GroupTarget, GroupKey, GroupTimestamp and GroupDuration, with
+	// any other named group becoming metadata.
+	Regexp string
+	// TargetID and Key name the series of lines without a target or key
+	// group
+	TargetID string
+	Key      string
+	// TimestampLayout parses the timestamp group, as a time.Parse layout or
+	// one of TimestampUnix, TimestampUnixMs and TimestampUnixNs. Defaults to
+	// DefaultTailTimestampLayout. Lines without a timestamp group are
+	// stamped with the time they are read.
+	TimestampLayout string
+	// DurationUnit is the unit of a plain number in the duration group.
+	// Defaults to time.Millisecond. Durations with a unit, such as "1.5s",
+	// are parsed with time.ParseDuration. Lines without a duration group are
+	// points in time, measured by their intervals.
+	DurationUnit time.Duration
+	// Metadata is added to every event of the pattern
+	Metadata map[string]string
+}
+
+// TailConfig configures a Tailer
+type TailConfig struct {
+	// Paths are the files to follow. A file that doesn't exist yet is read
+	// once it appears.
+	Paths []string
+	// Patterns are tried on each line in order; the first match wins
+	Patterns []TailPattern
+	// PollInterval is how often files are checked for new lines, rotation
+	// and truncation. Defaults to DefaultTailPollInterval.
+	PollInterval time.Duration
+	// FromStart reads the lines already in the files at startup rather than
+	// only the lines appended afterwards
+	FromStart bool
+}
+
+// TailStats counts what a Tailer read
+type TailStats struct {
+	Lines          uint64 // Complete lines read
+	Events         uint64 // Events the sink accepted
+	DroppedEvents  uint64 // Valid events the sink rejected
+	UnmatchedLines uint64 // Lines no pattern matched
+	InvalidLines   uint64 // Matched lines without a valid event, or too long
+	Rotations      uint64 // Files replaced or truncated while followed
+}
+
+type tailPattern struct {
+	TailPattern
+	re *regexp.Regexp
+}
+
+// Tailer follows log files and turns the lines matching its patterns into
+// events. Files are polled, so rotation by renaming or copying and
+// truncating is followed: the old file is read to its end before the new one
+// is opened.
+type Tailer struct {
+	config   TailConfig
+	sink     Sink
+	patterns []tailPattern
+
+	lines          atomic.Uint64
+	events         atomic.Uint64
+	droppedEvents  atomic.Uint64
+	unmatchedLines atomic.Uint64
+	invalidLines   atomic.Uint64
+	rotations      atomic.Uint64
+}
+
+// NewTailer compiles the patterns of config. Errors wrap ErrInvalidPattern.
+func NewTailer(config TailConfig, sink Sink) (*Tailer, error) {
+	if config.PollInterval <= 0 {
+		config.PollInterval = DefaultTailPollInterval
+	}
+
+	t := &Tailer{config: config, sink: sink}
+	for i, pattern := range config.Patterns {
+		re, err := regexp.Compile(pattern.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("%w %d: %v", ErrInvalidPattern, i, err)
+		}
+		if pattern.TargetID == "" && re.SubexpIndex(GroupTarget) < 0 {
+			return nil, fmt.Errorf("%w %d: needs a target ID or a %q group", ErrInvalidPattern, i, GroupTarget)
+		}
+		if pattern.Key == "" && re.SubexpIndex(GroupKey) < 0 {
+			return nil, fmt.Errorf("%w %d: needs a key or a %q group", ErrInvalidPattern, i, GroupKey)
+		}
+		if pattern.TimestampLayout == "" {
+			pattern.TimestampLayout = DefaultTailTimestampLayout
+		}
+		if pattern.DurationUnit <= 0 {
+			pattern.DurationUnit = time.Millisecond
+		}
+		t.patterns = append(t.patterns, tailPattern{TailPattern: pattern, re: re})
+	}
+	return t, nil
+}
+
+// Stats returns the counters of the tailer
+func (t *Tailer) Stats() TailStats {
+	return TailStats{
+		Lines:          t.lines.Load(),
+		Events:         t.events.Load(),
+		DroppedEvents:  t.droppedEvents.Load(),
+		UnmatchedLines: t.unmatchedLines.Load(),
+		InvalidLines:   t.invalidLines.Load(),
+		Rotations:      t.rotations.Load(),
+	}
+}
+
+// Serve follows the files until the context is canceled
+func (t *Tailer) Serve(ctx context.Context) error {
+	files := make([]*tailedFile, len(t.config.Paths))
+	for i, path := range t.config.Paths {
+		files[i] = &tailedFile{path: path, skipExisting: !t.config.FromStart}
+	}
+	defer func() {
+		for _, f := range files {
+			f.close()
+		}
+	}()
+
+	ticker := time.NewTicker(t.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		for _, f := range files {
+			t.poll(f)
+			// Files appearing later are read from their start
+			f.skipExisting = false
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// tailedFile is the state of one followed path
+type tailedFile struct {
+	path         string
+	file         *os.File
+	info         os.FileInfo // Of the open file
+	offset       int64
+	partial      []byte // Unterminated line read so far
+	skipping     bool   // Discarding the rest of a line over maxTailLine
+	skipExisting bool   // Start at the end of the file found at startup
+	openErr      error  // Last error opening the path, to log it once
+}
+
+func (f *tailedFile) open() bool {
+	file, err := os.Open(f.path)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = file.Stat(); err != nil {
+			file.Close()
+		} else {
+			f.file, f.info, f.offset = file, info, 0
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) && (f.openErr == nil || f.openErr.Error() != err.Error()) {
+			log.Printf("Error opening %s: %v", f.path, err)
+		}
+		f.openErr = err
+		return false
+	}
+	f.openErr = nil
+
+	if f.skipExisting {
+		if offset, err := f.file.Seek(0, io.SeekEnd); err == nil {
+			f.offset = offset
+		}
+	}
+	return true
+}
+
+func (f *tailedFile) close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	f.partial = nil
+	f.skipping = false
+}
+
+// poll reads what was appended to a file since the last poll and follows
+// rotation and truncation
+func (t *Tailer) poll(f *tailedFile) {
+	if f.file == nil && !f.open() {
+		return
+	}
+
+	// Truncated in place, as by copytruncate
+	if info, err := f.file.Stat(); err == nil && info.Size() < f.offset {
+		t.rotations.Add(1)
+		f.partial, f.skipping = nil, false
+		if _, err := f.file.Seek(0, io.SeekStart); err == nil {
+			f.offset = 0
+		}
+	}
+	t.readAvailable(f)
+
+	// Replaced by a new file; the old one was just read to its end
+	if info, err := os.Stat(f.path); err == nil && !os.SameFile(info, f.info) {
+		t.rotations.Add(1)
+		f.close()
+		f.skipExisting = false
+		if f.open() {
+			t.readAvailable(f)
+		}
+	}
+}
+
+// readAvailable reads a file to its current end and handles its complete lines
+func (t *Tailer) readAvailable(f *tailedFile) {
+	buf := make([]byte, tailReadSize)
+	for {
+		n, err := f.file.Read(buf)
+		f.offset += int64(n)
+		data := buf[:n]
+		for len(data) > 0 {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				if !f.skipping {
+					f.partial = append(f.partial, data...)
+				}
+				break
+			}
+			if !f.skipping {
+				t.handleLine(string(append(f.partial, data[:i]...)))
+			}
+			f.partial, f.skipping = f.partial[:0], false
+			data = data[i+1:]
+		}
+		if len(f.partial) > maxTailLine {
+			t.invalidLines.Add(1)
+			f.partial, f.skipping = f.partial[:0], true
+		}
+
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("Error reading %s: %v", f.path, err)
+			}
+			return
+		}
+	}
+}
+
+// handleLine sends the event extracted from a line to the sink
+func (t *Tailer) handleLine(line string) {
+	t.lines.Add(1)
+	line = strings.TrimSuffix(line, "\r")
+
+	event, err := t.parseLine(line, time.Now())
+	if errors.Is(err, ErrNoMatch) {
+		t.unmatchedLines.Add(1)
+		return
+	}
+	if err != nil {
+		t.invalidLines.Add(1)
+		return
+	}
+	if err := t.sink.ProcessEvent(event); err != nil {
+		t.droppedEvents.Add(1)
+		return
+	}
+	t.events.Add(1)
+}
+
+// parseLine extracts an event with the first pattern matching the line
+func (t *Tailer) parseLine(line string, now time.Time) (*proto.Event, error) {
+	for _, pattern := range t.patterns {
+		match := pattern.re.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		event := &proto.Event{
+			TargetId:        pattern.TargetID,
+			Key:             pattern.Key,
+			ServerTimestamp: now.UnixNano(),
+		}
+		for name, value := range pattern.Metadata {
+			if event.Metadata == nil {
+				event.Metadata = make(map[string]string)
+			}
+			event.Metadata[name] = value
+		}
+		for i, name := range pattern.re.SubexpNames() {
+			value := match[i]
+			if name == "" || value == "" {
+				continue
+			}
+			switch name {
+			case GroupTarget:
+				event.TargetId = value
+			case GroupKey:
+				event.Key = value
+			case GroupTimestamp:
+				ts, err := parseTimestamp(value, pattern.TimestampLayout)
+				if err != nil {
+					return nil, err
+				}
+				event.ServerTimestamp = ts.UnixNano()
+			case GroupDuration:
+				duration, err := parseDuration(value, pattern.DurationUnit)
+				if err != nil {
+					return nil, err
+				}
+				durationNs := duration.Nanoseconds()
+				event.DurationNs = &durationNs
+			default:
+				if event.Metadata == nil {
+					event.Metadata = make(map[string]string)
+				}
+				event.Metadata[name] = value
+			}
+		}
+		if err := calculator.ValidateEvent(event); err != nil {
+			return nil, err
+		}
+		return event, nil
+	}
+	return nil, ErrNoMatch
+}
+
+// parseTimestamp reads a timestamp in a time.Parse layout or a Unix layout
+func parseTimestamp(value, layout string) (time.Time, error) {
+	scale := map[string]int64{
+		TimestampUnix:   int64(time.Second),
+		TimestampUnixMs: int64(time.Millisecond),
+		TimestampUnixNs: 1,
+	}
+	unit, isUnix := scale[layout]
+	if !isUnix {
+		return time.Parse(layout, value)
+	}
+
+	// Whole numbers are scaled exactly; nanoseconds don't fit a float64
+	if number, err := strconv.ParseInt(value, 10, 64); err == nil && number > 0 {
+		return time.Unix(0, number*unit), nil
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || !(number > 0) || math.IsInf(number, 0) {
+		return time.Time{}, fmt.Errorf("invalid %s timestamp %q", layout, value)
+	}
+	return time.Unix(0, int64(number*float64(unit))), nil
+}
+
+// parseDuration reads a plain number in unit or a Go duration
+func parseDuration(value string, unit time.Duration) (time.Duration, error) {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return time.ParseDuration(value)
+	}
+	if number < 0 || math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return time.Duration(number * float64(unit)), nil
+}
+
+// String summarizes the counters for logs
+func (s TailStats) String() string {
+	return fmt.Sprintf("%d lines, %d events (%d dropped), %d unmatched and %d invalid lines, %d rotations",
+		s.Lines, s.Events, s.DroppedEvents, s.UnmatchedLines, s.InvalidLines, s.Rotations)
+}
@@ -0,0 +1,131 @@
+package ingest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// accessLogPattern reads lines like
+// 2024-05-01T12:00:00Z web GET /login 200 12.5
+const accessLogPattern = `^(?P<timestamp>\S+) (?P<target>\S+) (?P<method>[A-Z]+) (?P<key>\S+) (?P<status>\d{3}) (?P<duration>\S+)$`
+
+func TestTailerParseLine(t *testing.T) {
+	tailer, err := NewTailer(TailConfig{Patterns: []TailPattern{
+		{Regexp: accessLogPattern, Metadata: map[string]string{"source": "access"}},
+		{Regexp: `^job (?P<key>\w+) done at (?P<timestamp>\d+)$`, TargetID: "cron", TimestampLayout: TimestampUnixMs},
+	}}, &recordingSink{})
+	require.NoError(t, err)
+	now := time.Now()
+
+	event, err := tailer.parseLine("2024-05-01T12:00:00Z web GET /login 200 12.5", now)
+	require.NoError(t, err)
+	assert.Equal(t, "web", event.TargetId)
+	assert.Equal(t, "/login", event.Key)
+	assert.Equal(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).UnixNano(), event.ServerTimestamp)
+	assert.Equal(t, int64(12500*time.Microsecond), event.GetDurationNs())
+	assert.Equal(t, map[string]string{"source": "access", "method": "GET", "status": "200"}, event.Metadata)
+
+	event, err = tailer.parseLine("2024-05-01T12:00:00Z web GET /login 200 1.5s", now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1500*time.Millisecond), event.GetDurationNs())
+
+	event, err = tailer.parseLine("job backup done at 1700000000123", now)
+	require.NoError(t, err)
+	assert.Equal(t, "cron", event.TargetId)
+	assert.Equal(t, "backup", event.Key)
+	assert.Equal(t, time.UnixMilli(1700000000123).UnixNano(), event.ServerTimestamp)
+	assert.Nil(t, event.DurationNs)
+
+	_, err = tailer.parseLine("something else entirely", now)
+	assert.ErrorIs(t, err, ErrNoMatch)
+	_, err = tailer.parseLine("yesterday web GET /login 200 12.5", now)
+	assert.Error(t, err)
+	_, err = tailer.parseLine("2024-05-01T12:00:00Z web GET /login 200 fast", now)
+	assert.Error(t, err)
+}
+
+func TestNewTailerInvalidPattern(t *testing.T) {
+	for _, pattern := range []TailPattern{
+		{Regexp: `(`, TargetID: "web", Key: "login"},
+		{Regexp: `(?P<key>\w+)`},
+		{Regexp: `(?P<target>\w+)`},
+	} {
+		_, err := NewTailer(TailConfig{Patterns: []TailPattern{pattern}}, &recordingSink{})
+		assert.ErrorIs(t, err, ErrInvalidPattern, pattern.Regexp)
+	}
+}
+
+func TestTailerFollowsRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	require.NoError(t, os.WriteFile(path, []byte("2024-05-01T12:00:00Z web GET /old 200 1\n"), 0o644))
+
+	sink := &recordingSink{}
+	tailer, err := NewTailer(TailConfig{
+		Paths:        []string{path},
+		Patterns:     []TailPattern{{Regexp: accessLogPattern}},
+		PollInterval: 10 * time.Millisecond,
+	}, sink)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- tailer.Serve(ctx)
+	}()
+	defer func() {
+		cancel()
+		assert.ErrorIs(t, <-errChan, context.Canceled)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	appendLog := func(path, data string) {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		require.NoError(t, err)
+		_, err = f.WriteString(data)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	waitForEvents := func(n int) {
+		t.Helper()
+		require.Eventually(t, func() bool { return len(sink.Events()) == n }, time.Second, 10*time.Millisecond)
+	}
+
+	// Lines written before the tailer started are skipped; a line written in
+	// two parts is read once complete
+	appendLog(path, "2024-05-01T12:00:01Z web GET /login 200 10\n2024-05-01T12:00:02Z web GET /lo")
+	waitForEvents(1)
+	appendLog(path, "gin 200 20\nnot an access log line\n")
+	waitForEvents(2)
+
+	// Rotation by rename: the rest of the old file is read before the new one
+	appendLog(path, "2024-05-01T12:00:03Z web GET /login 200 30\n")
+	require.NoError(t, os.Rename(path, path+".1"))
+	appendLog(path+".1", "2024-05-01T12:00:04Z web GET /login 200 40\n")
+	appendLog(path, "2024-05-01T12:00:05Z web GET /login 200 50\n")
+	waitForEvents(5)
+
+	// Rotation by truncation
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, os.Truncate(path, 0))
+	time.Sleep(50 * time.Millisecond)
+	appendLog(path, "2024-05-01T12:00:06Z web GET /login 200 60\n")
+	waitForEvents(6)
+
+	for i, event := range sink.Events() {
+		assert.Equal(t, "/login", event.Key)
+		assert.Equal(t, int64(i+1)*int64(10*time.Millisecond), event.GetDurationNs())
+	}
+	stats := tailer.Stats()
+	assert.Equal(t, uint64(7), stats.Lines)
+	assert.Equal(t, uint64(6), stats.Events)
+	assert.Equal(t, uint64(1), stats.UnmatchedLines)
+	assert.Equal(t, uint64(2), stats.Rotations)
+}
@@ -0,0 +1,252 @@
+// Package prober measures real services the way the generator package fakes
+// them: each Prober periodically probes one address and emits the duration
+// as an Event.
+package prober
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+// Kind is the protocol a Prober measures
+type Kind string
+
+const (
+	// KindHTTP measures an HTTP request to a URL, up to the end of the body
+	KindHTTP Kind = "http"
+	// KindTCP measures opening a TCP connection to host:port
+	KindTCP Kind = "tcp"
+	// KindDNS measures resolving a host name
+	KindDNS Kind = "dns"
+)
+
+const (
+	DefaultInterval = 10 * time.Second
+	DefaultTimeout  = 5 * time.Second
+)
+
+// Metadata added to every probe event
+const (
+	MetadataProbe      = "probe"       // The Kind
+	MetadataResult     = "result"      // ResultSuccess or ResultFailure
+	MetadataStatusCode = "status_code" // HTTP status code, when there is a response
+	MetadataError      = "error"       // Class of the error of a failure without a response
+)
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+var ErrUnknownKind = errors.New("unknown probe kind")
+
+type Config struct {
+	TargetID string
+	Key      string // Defaults to the address
+	Kind     Kind
+	// Address is the URL for HTTP, host:port for TCP and the host name for DNS
+	Address  string
+	Interval time.Duration // Defaults to DefaultInterval
+	Timeout  time.Duration // Defaults to DefaultTimeout
+	Metadata map[string]string
+	// Method is the HTTP method. Defaults to GET.
+	Method string
+	// Resolver resolves DNS probes. Defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+}
+
+// Prober emits one event per probe. Successes and failures carry a
+// different result in their metadata, so they are separate series, as are
+// HTTP responses with different status codes.
+type Prober struct {
+	config    Config
+	client    *http.Client
+	eventCh   chan *proto.Event
+	stopCh    chan struct{}
+	waitGroup sync.WaitGroup
+}
+
+func NewProber(config Config) (*Prober, error) {
+	switch config.Kind {
+	case KindHTTP, KindTCP, KindDNS:
+	default:
+		return nil, ErrUnknownKind
+	}
+	if config.Key == "" {
+		config.Key = config.Address
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.Method == "" {
+		config.Method = http.MethodGet
+	}
+	if config.Resolver == nil {
+		config.Resolver = net.DefaultResolver
+	}
+
+	return &Prober{
+		config: config,
+		// Every probe opens a new connection, so connecting is measured too
+		client: &http.Client{
+			Timeout:   config.Timeout,
+			Transport: &http.Transport{DisableKeepAlives: true},
+		},
+		eventCh: make(chan *proto.Event, 100),
+		stopCh:  make(chan struct{}),
+	}, nil
+}
+
+func (p *Prober) Start() {
+	p.waitGroup.Add(1)
+	go p.run()
+}
+
+func (p *Prober) Stop() {
+	close(p.stopCh)
+	p.waitGroup.Wait()
+}
+
+func (p *Prober) Events() <-chan *proto.Event {
+	return p.eventCh
+}
+
+func (p *Prober) run() {
+	defer p.waitGroup.Done()
+	defer close(p.eventCh)
+
+	// Stopping cancels the probe in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-p.stopCh
+		cancel()
+	}()
+
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		event := p.Probe(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case p.eventCh <- event:
+		case <-p.stopCh:
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+// Probe measures the address once
+func (p *Prober) Probe(ctx context.Context) *proto.Event {
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+
+	metadata := make(map[string]string, len(p.config.Metadata)+3)
+	for k, v := range p.config.Metadata {
+		metadata[k] = v
+	}
+	metadata[MetadataProbe] = string(p.config.Kind)
+
+	start := time.Now()
+	var err error
+	switch p.config.Kind {
+	case KindHTTP:
+		err = p.probeHTTP(ctx, metadata)
+	case KindTCP:
+		err = p.probeTCP(ctx)
+	case KindDNS:
+		err = p.probeDNS(ctx)
+	}
+	durationNs := time.Since(start).Nanoseconds()
+
+	metadata[MetadataResult] = ResultSuccess
+	if err != nil {
+		metadata[MetadataResult] = ResultFailure
+		if _, hasResponse := metadata[MetadataStatusCode]; !hasResponse {
+			metadata[MetadataError] = errorClass(err)
+		}
+	}
+	return &proto.Event{
+		TargetId:        p.config.TargetID,
+		Key:             p.config.Key,
+		ServerTimestamp: start.UnixNano(),
+		Metadata:        metadata,
+		DurationNs:      &durationNs,
+	}
+}
+
+// errHTTPStatus marks responses with an error status
+var errHTTPStatus = errors.New("error status")
+
+func (p *Prober) probeHTTP(ctx context.Context, metadata map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, p.config.Method, p.config.Address, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	metadata[MetadataStatusCode] = strconv.Itoa(resp.StatusCode)
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return errHTTPStatus
+	}
+	return nil
+}
+
+func (p *Prober) probeTCP(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.config.Address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (p *Prober) probeDNS(ctx context.Context) error {
+	_, err := p.config.Resolver.LookupHost(ctx, p.config.Address)
+	return err
+}
+
+// errorClass names the kind of a probe error for metadata
+func errorClass(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return "not_found"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	default:
+		return "error"
+	}
+}
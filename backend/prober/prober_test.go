@@ -0,0 +1,129 @@
+package prober
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTargetID = "test-target"
+
+func newTestProber(t *testing.T, config Config) *Prober {
+	t.Helper()
+	config.TargetID = testTargetID
+	p, err := NewProber(config)
+	require.NoError(t, err)
+	return p
+}
+
+func TestHTTPProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	p := newTestProber(t, Config{Kind: KindHTTP, Address: server.URL + "/health", Metadata: map[string]string{"region": "local"}})
+	event := p.Probe(t.Context())
+	assert.Equal(t, testTargetID, event.TargetId)
+	assert.Equal(t, server.URL+"/health", event.Key)
+	assert.Equal(t, map[string]string{
+		"region":           "local",
+		MetadataProbe:      "http",
+		MetadataResult:     ResultSuccess,
+		MetadataStatusCode: "200",
+	}, event.Metadata)
+	assert.GreaterOrEqual(t, event.GetDurationNs(), (20 * time.Millisecond).Nanoseconds())
+
+	p = newTestProber(t, Config{Kind: KindHTTP, Address: server.URL + "/broken", Key: "broken"})
+	event = p.Probe(t.Context())
+	assert.Equal(t, "broken", event.Key)
+	assert.Equal(t, ResultFailure, event.Metadata[MetadataResult])
+	assert.Equal(t, "500", event.Metadata[MetadataStatusCode])
+	assert.NotContains(t, event.Metadata, MetadataError)
+}
+
+func TestHTTPProbeTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	p := newTestProber(t, Config{Kind: KindHTTP, Address: server.URL, Timeout: 50 * time.Millisecond})
+	event := p.Probe(t.Context())
+	assert.Equal(t, ResultFailure, event.Metadata[MetadataResult])
+	assert.Equal(t, "timeout", event.Metadata[MetadataError])
+	assert.Less(t, event.GetDurationNs(), time.Second.Nanoseconds())
+}
+
+func TestTCPProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+
+	p := newTestProber(t, Config{Kind: KindTCP, Address: addr})
+	event := p.Probe(t.Context())
+	assert.Equal(t, ResultSuccess, event.Metadata[MetadataResult])
+	assert.Equal(t, "tcp", event.Metadata[MetadataProbe])
+
+	// Nobody listens on the port anymore
+	require.NoError(t, listener.Close())
+	event = p.Probe(t.Context())
+	assert.Equal(t, ResultFailure, event.Metadata[MetadataResult])
+	assert.Equal(t, "refused", event.Metadata[MetadataError])
+}
+
+func TestDNSProbe(t *testing.T) {
+	p := newTestProber(t, Config{Kind: KindDNS, Address: "localhost"})
+	event := p.Probe(t.Context())
+	assert.Equal(t, ResultSuccess, event.Metadata[MetadataResult])
+	assert.Equal(t, "dns", event.Metadata[MetadataProbe])
+
+	p = newTestProber(t, Config{Kind: KindDNS, Address: "does-not-exist.invalid"})
+	event = p.Probe(t.Context())
+	assert.Equal(t, ResultFailure, event.Metadata[MetadataResult])
+	assert.NotEmpty(t, event.Metadata[MetadataError])
+}
+
+func TestProberEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	p := newTestProber(t, Config{Kind: KindHTTP, Address: server.URL, Interval: 20 * time.Millisecond})
+	p.Start()
+
+	var timestamps []int64
+	for range 3 {
+		select {
+		case event := <-p.Events():
+			assert.Equal(t, ResultSuccess, event.Metadata[MetadataResult])
+			timestamps = append(timestamps, event.ServerTimestamp)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for probe events")
+		}
+	}
+	p.Stop()
+
+	for i := 1; i < len(timestamps); i++ {
+		assert.GreaterOrEqual(t, timestamps[i]-timestamps[i-1], (10 * time.Millisecond).Nanoseconds())
+	}
+	_, open := <-p.Events()
+	assert.False(t, open)
+}
+
+func TestNewProberUnknownKind(t *testing.T) {
+	_, err := NewProber(Config{Kind: "icmp", Address: "localhost"})
+	assert.ErrorIs(t, err, ErrUnknownKind)
+}
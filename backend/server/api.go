@@ -0,0 +1,254 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/calculator"
+	"github.com/elodin/latency-dash/backend/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const (
+	// defaultHistoryRange is how far back a history query reaches without a from
+	defaultHistoryRange = 1 * time.Hour
+
+	// maxRequestBody bounds the size of request bodies
+	maxRequestBody = 1 << 20
+)
+
+// APIServer serves the HTTP API next to the WebSocket endpoint
+type APIServer struct {
+	calculator *calculator.MetricsCalculator
+}
+
+func NewAPIServer(calculator *calculator.MetricsCalculator) *APIServer {
+	return &APIServer{calculator: calculator}
+}
+
+// HandleSeriesHistory serves GET /api/series/{id}/history?from=&to=&step=.
+// from and to are RFC 3339 timestamps or Unix seconds, step is a Go duration
+// such as "1m". Without a step the finest resolution covering the range is used.
+func (s *APIServer) HandleSeriesHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	to := time.Now()
+	if v := query.Get("to"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+
+	from := to.Add(-defaultHistoryRange)
+	if v := query.Get("from"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	var step time.Duration
+	if v := query.Get("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid step: "+v, http.StatusBadRequest)
+			return
+		}
+		step = d
+	}
+
+	history, err := s.calculator.History(r.PathValue("id"), from, to, step)
+	if errors.Is(err, calculator.ErrSeriesNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, history)
+}
+
+// HandleSeriesHeatmap serves GET /api/series/{id}/heatmap with the retained
+// heatmap columns of a series
+func (s *APIServer) HandleSeriesHeatmap(w http.ResponseWriter, r *http.Request) {
+	seriesID := r.PathValue("id")
+	frames, err := s.calculator.Heatmap(seriesID)
+	if errors.Is(err, calculator.ErrSeriesNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &proto.HeatmapFrames{SeriesId: seriesID, Frames: frames})
+}
+
+// HandleTargets serves GET /api/targets with the per-target counters
+func (s *APIServer) HandleTargets(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, &proto.TargetStatsList{Targets: s.calculator.TargetStats()})
+}
+
+// HandleDiscovery serves GET /api/discovery?target= with the targets, keys
+// and metadata dimensions of all series, or of a single target
+func (s *APIServer) HandleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.calculator.Discovery(r.URL.Query().Get("target")))
+}
+
+// HandleCreateBaseline serves POST /api/baselines, capturing the current
+// stats of a target under a name. The body is a JSON BaselineRequest.
+func (s *APIServer) HandleCreateBaseline(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBody))
+	if err != nil {
+		http.Error(w, "reading body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req proto.BaselineRequest
+	if err := protojson.Unmarshal(body, &req); err != nil {
+		http.Error(w, "invalid baseline request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	baseline, err := s.calculator.CaptureBaseline(req.Name, req.TargetId)
+	switch {
+	case errors.Is(err, calculator.ErrInvalidBaseline):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, calculator.ErrTargetNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, calculator.ErrBaselineExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/api/baselines/"+url.PathEscape(baseline.Name))
+	writeJSONStatus(w, http.StatusCreated, baseline)
+}
+
+// HandleBaselines serves GET /api/baselines with all captured baselines
+func (s *APIServer) HandleBaselines(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, &proto.BaselineList{Baselines: s.calculator.Baselines()})
+}
+
+// HandleBaseline serves GET /api/baselines/{name}
+func (s *APIServer) HandleBaseline(w http.ResponseWriter, r *http.Request) {
+	baseline, err := s.calculator.Baseline(r.PathValue("name"))
+	if errors.Is(err, calculator.ErrBaselineNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, baseline)
+}
+
+// HandleDeleteBaseline serves DELETE /api/baselines/{name}
+func (s *APIServer) HandleDeleteBaseline(w http.ResponseWriter, r *http.Request) {
+	err := s.calculator.DeleteBaseline(r.PathValue("name"))
+	if errors.Is(err, calculator.ErrBaselineNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleCapture serves GET /api/capture with the status of the running or
+// latest event capture
+func (s *APIServer) HandleCapture(w http.ResponseWriter, r *http.Request) {
+	status := s.calculator.CaptureStatus()
+	if status == nil {
+		status = &proto.CaptureStatus{}
+	}
+	writeJSON(w, status)
+}
+
+// HandleStartCapture serves POST /api/capture, recording every incoming event
+// to capture files until DELETE /api/capture
+func (s *APIServer) HandleStartCapture(w http.ResponseWriter, r *http.Request) {
+	status, err := s.calculator.StartCapture()
+	if err != nil {
+		writeCaptureError(w, err)
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, status)
+}
+
+// HandleStopCapture serves DELETE /api/capture with the final status of the
+// stopped capture
+func (s *APIServer) HandleStopCapture(w http.ResponseWriter, r *http.Request) {
+	status, err := s.calculator.StopCapture()
+	if err != nil {
+		writeCaptureError(w, err)
+		return
+	}
+	writeJSON(w, status)
+}
+
+func writeCaptureError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, calculator.ErrCaptureDisabled):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	case errors.Is(err, calculator.ErrCaptureActive), errors.Is(err, calculator.ErrCaptureInactive):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// parseTime accepts RFC 3339 timestamps as well as Unix seconds
+func parseTime(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// writeJSON writes msg as protojson with camelCase field names, matching the
+// WebSocket protocol
+func writeJSON(w http.ResponseWriter, msg protobuf.Message) {
+	writeJSONStatus(w, http.StatusOK, msg)
+}
+
+// writeJSONStatus is writeJSON with a status code other than 200 OK
+func writeJSONStatus(w http.ResponseWriter, status int, msg protobuf.Message) {
+	marshaler := protojson.MarshalOptions{
+		UseProtoNames: false, // Use camelCase instead of snake_case
+	}
+	data, err := marshaler.Marshal(msg)
+	if err != nil {
+		log.Printf("Error marshaling response: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/calculator"
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// startAPIServer runs a calculator and serves the HTTP API for it
+func startAPIServer(t *testing.T) (*calculator.MetricsCalculator, *httptest.Server) {
+	t.Helper()
+	return startAPIServerWithConfig(t, calculator.Config{})
+}
+
+// startAPIServerWithConfig is startAPIServer with a configured calculator
+func startAPIServerWithConfig(t *testing.T, config calculator.Config) (*calculator.MetricsCalculator, *httptest.Server) {
+	t.Helper()
+	calc := calculator.NewMetricsCalculatorWithConfig(config)
+	ctx, cancel := context.WithCancel(t.Context())
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- calc.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		calc.Stop()
+		cancel()
+		if err := <-errChan; err != nil && err != context.Canceled {
+			t.Errorf("Metric calculator returned unexpected error: %v", err)
+		}
+	})
+
+	apiServer := NewAPIServer(calc)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/series/{id}/history", apiServer.HandleSeriesHistory)
+	mux.HandleFunc("GET /api/series/{id}/heatmap", apiServer.HandleSeriesHeatmap)
+	mux.HandleFunc("GET /api/targets", apiServer.HandleTargets)
+	mux.HandleFunc("GET /api/discovery", apiServer.HandleDiscovery)
+	mux.HandleFunc("POST /api/events", apiServer.HandleEvents)
+	mux.HandleFunc("POST /api/baselines", apiServer.HandleCreateBaseline)
+	mux.HandleFunc("GET /api/baselines", apiServer.HandleBaselines)
+	mux.HandleFunc("GET /api/baselines/{name}", apiServer.HandleBaseline)
+	mux.HandleFunc("DELETE /api/baselines/{name}", apiServer.HandleDeleteBaseline)
+	mux.HandleFunc("GET /api/capture", apiServer.HandleCapture)
+	mux.HandleFunc("POST /api/capture", apiServer.HandleStartCapture)
+	mux.HandleFunc("DELETE /api/capture", apiServer.HandleStopCapture)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return calc, server
+}
+
+func TestSeriesHistoryAPI(t *testing.T) {
+	calc, server := startAPIServer(t)
+
+	base := time.Now().Truncate(time.Minute)
+	for i := range 3 {
+		event := &proto.Event{
+			TargetId:        "test-target",
+			Key:             "test-key",
+			ServerTimestamp: base.Add(time.Duration(i) * time.Second).UnixNano(),
+			Metadata:        map[string]string{"tier": "test"},
+		}
+		require.NoError(t, calc.ProcessEvent(event))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	seriesID := "test-target:test-key:tier=test"
+	query := url.Values{
+		"from": {base.Format(time.RFC3339)},
+		"to":   {base.Add(time.Minute).Format(time.RFC3339)},
+		"step": {"1m"},
+	}
+	resp, err := http.Get(server.URL + "/api/series/" + url.PathEscape(seriesID) + "/history?" + query.Encode())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var history proto.SeriesHistory
+	require.NoError(t, protojson.Unmarshal(body, &history))
+	assert.Equal(t, seriesID, history.SeriesId)
+	assert.Equal(t, int64(time.Minute), history.Step)
+	require.Len(t, history.Buckets, 1)
+	assert.Equal(t, int64(2), history.Buckets[0].Count)
+}
+
+func TestSeriesHistoryAPIErrors(t *testing.T) {
+	_, server := startAPIServer(t)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"unknown_series", "/api/series/missing/history", http.StatusNotFound},
+		{"bad_from", "/api/series/missing/history?from=yesterday", http.StatusBadRequest},
+		{"bad_step", "/api/series/missing/history?step=often", http.StatusBadRequest},
+		{"inverted_range", "/api/series/missing/history?from=200&to=100", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + tt.path)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+		})
+	}
+}
+
+func TestSeriesHeatmapAPI(t *testing.T) {
+	calc, server := startAPIServer(t)
+
+	base := time.Now().Truncate(time.Minute)
+	for i := range 3 {
+		event := &proto.Event{
+			TargetId:        "test-target",
+			Key:             "test-key",
+			ServerTimestamp: base.Add(time.Duration(i*15) * time.Second).UnixNano(),
+		}
+		require.NoError(t, calc.ProcessEvent(event))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get(server.URL + "/api/series/" + url.PathEscape("test-target:test-key") + "/heatmap")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var frames proto.HeatmapFrames
+	require.NoError(t, protojson.Unmarshal(body, &frames))
+	require.Len(t, frames.Frames, 2)
+	assert.Equal(t, base.Add(10*time.Second).UnixNano(), frames.Frames[0].Start)
+	assert.Len(t, frames.Frames[0].Counts, len(calculator.DefaultHeatmapBuckets)+1)
+
+	resp, err = http.Get(server.URL + "/api/series/missing/heatmap")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestTargetsAPI(t *testing.T) {
+	_, server := startAPIServer(t)
+
+	resp, err := http.Get(server.URL + "/api/targets")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var targets proto.TargetStatsList
+	require.NoError(t, protojson.Unmarshal(body, &targets))
+	assert.Empty(t, targets.Targets)
+}
+
+func TestBaselinesAPI(t *testing.T) {
+	calc, server := startAPIServer(t)
+
+	base := time.Now()
+	for i := range 3 {
+		event := &proto.Event{
+			TargetId:        "test-target",
+			Key:             "test-key",
+			ServerTimestamp: base.Add(time.Duration(i) * 100 * time.Millisecond).UnixNano(),
+		}
+		require.NoError(t, calc.ProcessEvent(event))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	create := func(body string) *http.Response {
+		resp, err := http.Post(server.URL+"/api/baselines", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := create(`{"name": "pre-rollout", "targetId": "test-target"}`)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "/api/baselines/pre-rollout", resp.Header.Get("Location"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var baseline proto.Baseline
+	require.NoError(t, protojson.Unmarshal(body, &baseline))
+	require.Len(t, baseline.Series, 1)
+	assert.InDelta(t, 100.0, baseline.Series[0].Avg, 1e-6)
+
+	for _, tt := range []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"duplicate", `{"name": "pre-rollout", "targetId": "test-target"}`, http.StatusConflict},
+		{"unknown_target", `{"name": "other", "targetId": "missing"}`, http.StatusNotFound},
+		{"missing_name", `{"targetId": "test-target"}`, http.StatusBadRequest},
+		{"malformed", `{`, http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := create(tt.body)
+			resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+		})
+	}
+
+	// Later updates of the series carry their delta against the baseline
+	require.NoError(t, calc.ProcessEvent(&proto.Event{
+		TargetId:        "test-target",
+		Key:             "test-key",
+		ServerTimestamp: base.Add(600 * time.Millisecond).UnixNano(),
+	}))
+	time.Sleep(100 * time.Millisecond)
+	updates := calc.GetAllMetrics()
+	require.Len(t, updates, 1)
+	require.Len(t, updates[0].BaselineDeltas, 1)
+	assert.Equal(t, "pre-rollout", updates[0].BaselineDeltas[0].Baseline)
+	assert.InDelta(t, 100.0, updates[0].BaselineDeltas[0].AvgDelta, 1e-6)
+	assert.InDelta(t, 1.0, updates[0].BaselineDeltas[0].AvgRatio, 1e-6)
+
+	resp, err = http.Get(server.URL + "/api/baselines")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	var list proto.BaselineList
+	require.NoError(t, protojson.Unmarshal(body, &list))
+	require.Len(t, list.Baselines, 1)
+	assert.Equal(t, "pre-rollout", list.Baselines[0].Name)
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/api/baselines/pre-rollout", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/api/baselines/pre-rollout")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDiscoveryAPI(t *testing.T) {
+	calc, server := startAPIServer(t)
+
+	for _, target := range []string{"a", "b"} {
+		require.NoError(t, calc.ProcessEvent(&proto.Event{
+			TargetId:        target,
+			Key:             "test-key",
+			ServerTimestamp: time.Now().UnixNano(),
+			Metadata:        map[string]string{"tier": "test"},
+		}))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get(server.URL + "/api/discovery?target=b")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var index proto.DiscoveryIndex
+	require.NoError(t, protojson.Unmarshal(body, &index))
+	require.Len(t, index.Targets, 1)
+	assert.Equal(t, "b", index.Targets[0].TargetId)
+	require.Len(t, index.Targets[0].Dimensions, 1)
+	assert.Equal(t, "tier", index.Targets[0].Dimensions[0].Name)
+}
+
+func TestCaptureAPI(t *testing.T) {
+	calc, server := startAPIServerWithConfig(t, calculator.Config{CaptureDir: t.TempDir()})
+
+	do := func(method string) (int, *proto.CaptureStatus) {
+		req, err := http.NewRequest(method, server.URL+"/api/capture", nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		var status proto.CaptureStatus
+		if resp.StatusCode < http.StatusBadRequest {
+			require.NoError(t, protojson.Unmarshal(body, &status))
+		}
+		return resp.StatusCode, &status
+	}
+
+	code, status := do(http.MethodGet)
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, status.Active)
+	code, _ = do(http.MethodDelete)
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, status = do(http.MethodPost)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.True(t, status.Active)
+	code, _ = do(http.MethodPost)
+	assert.Equal(t, http.StatusConflict, code)
+
+	require.NoError(t, calc.ProcessEvent(&proto.Event{
+		TargetId:        "test-target",
+		Key:             "test-key",
+		ServerTimestamp: time.Now().UnixNano(),
+	}))
+
+	code, status = do(http.MethodDelete)
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, status.Active)
+	assert.Equal(t, int64(1), status.Events)
+	assert.Len(t, status.Files, 1)
+
+	code, status = do(http.MethodGet)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int64(1), status.Events)
+
+	// Capture needs a directory
+	_, disabled := startAPIServer(t)
+	resp, err := http.Post(disabled.URL+"/api/capture", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+}
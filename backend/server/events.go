@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/calculator"
+	"github.com/elodin/latency-dash/backend/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const (
+	// maxEventsBody bounds the size of an ingestion request
+	maxEventsBody = 16 << 20
+
+	// Content types of binary protobuf bodies. The messageType parameter
+	// selects between "Event" and "EventBatch", the default.
+	contentTypeProtobuf         = "application/x-protobuf"
+	contentTypeProtobufStandard = "application/protobuf"
+
+	// Streaming producers are asked to slow down once the calculator queue
+	// is this full
+	ingestHighWatermark = 0.8
+	ingestRetryAfter    = 100 * time.Millisecond
+)
+
+// HandleEvents serves POST /api/events. The body is a single Event or an
+// EventBatch, either as protojson (application/json) or binary protobuf
+// (application/x-protobuf). JSON bodies with an "events" array are batches;
+// binary bodies are batches unless the Content-Type carries
+// messageType=Event. The response is an IngestResponse in the same encoding,
+// listing the events that were rejected. It is 200 OK if any event was
+// accepted, 400 Bad Request if every event was invalid and 503 Service
+// Unavailable if the calculator turned events away.
+func (s *APIServer) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "application/json"
+	}
+	binary := mediaType == contentTypeProtobuf || mediaType == contentTypeProtobufStandard
+	if !binary && mediaType != "application/json" {
+		http.Error(w, "unsupported content type: "+mediaType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEventsBody))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "reading body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var events []*proto.Event
+	if binary {
+		events, err = decodeProtobufEvents(body, params["messagetype"])
+	} else {
+		events, err = decodeJSONEvents(body)
+	}
+	if err != nil {
+		http.Error(w, "invalid events: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, rejected := ingestEvents(s.calculator, events)
+
+	status := http.StatusOK
+	switch {
+	case response.Accepted > 0 || len(events) == 0:
+	case rejected:
+		status = http.StatusServiceUnavailable
+	default:
+		status = http.StatusBadRequest
+	}
+
+	if binary {
+		writeProtobuf(w, status, response)
+		return
+	}
+	writeJSONStatus(w, status, response)
+}
+
+// ingestEvents validates events and queues them for the calculator. rejected
+// reports whether the calculator turned valid events away.
+func ingestEvents(calc *calculator.MetricsCalculator, events []*proto.Event) (response *proto.IngestResponse, rejected bool) {
+	response = &proto.IngestResponse{}
+	for i, event := range events {
+		err := calculator.ValidateEvent(event)
+		if err == nil {
+			if err = calc.ProcessEvent(event); err != nil {
+				rejected = true
+			}
+		}
+		if err != nil {
+			response.Errors = append(response.Errors, &proto.IngestError{Index: int32(i), Message: err.Error()})
+			continue
+		}
+		response.Accepted++
+	}
+	return response, rejected
+}
+
+// newIngestAck acknowledges events of a stream, asking the producer to back
+// off when events were rejected or the calculator queue is filling up
+func newIngestAck(calc *calculator.MetricsCalculator, sequence uint64, response *proto.IngestResponse, rejected bool) *proto.IngestAck {
+	ack := &proto.IngestAck{
+		Sequence:   sequence,
+		Accepted:   response.Accepted,
+		Errors:     response.Errors,
+		QueueUsage: calc.QueueUsage(),
+	}
+	if rejected || ack.QueueUsage >= ingestHighWatermark {
+		ack.RetryAfterMs = int32(ingestRetryAfter.Milliseconds())
+	}
+	return ack
+}
+
+// decodeJSONEvents reads a protojson Event or EventBatch
+func decodeJSONEvents(body []byte) ([]*proto.Event, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	if _, isBatch := fields["events"]; isBatch {
+		var batch proto.EventBatch
+		if err := protojson.Unmarshal(body, &batch); err != nil {
+			return nil, err
+		}
+		return batch.Events, nil
+	}
+
+	var event proto.Event
+	if err := protojson.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	return []*proto.Event{&event}, nil
+}
+
+// decodeProtobufEvents reads a binary Event or EventBatch as selected by the
+// messageType parameter
+func decodeProtobufEvents(body []byte, messageType string) ([]*proto.Event, error) {
+	switch strings.TrimPrefix(messageType, "latencydash.") {
+	case "Event":
+		var event proto.Event
+		if err := protobuf.Unmarshal(body, &event); err != nil {
+			return nil, err
+		}
+		return []*proto.Event{&event}, nil
+	case "", "EventBatch":
+		var batch proto.EventBatch
+		if err := protobuf.Unmarshal(body, &batch); err != nil {
+			return nil, err
+		}
+		return batch.Events, nil
+	default:
+		return nil, errors.New("unknown message type " + messageType)
+	}
+}
+
+// writeProtobuf writes msg as binary protobuf
+func writeProtobuf(w http.ResponseWriter, status int, msg protobuf.Message) {
+	data, err := protobuf.Marshal(msg)
+	if err != nil {
+		log.Printf("Error marshaling response: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeProtobuf)
+	w.WriteHeader(status)
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// unixNano formats a time the way protojson encodes int64 timestamps
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// postEvents sends a body to the ingestion endpoint and decodes the response
+func postEvents(t *testing.T, url, contentType string, body []byte) (int, *proto.IngestResponse) {
+	t.Helper()
+	resp, err := http.Post(url+"/api/events", contentType, bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	var response proto.IngestResponse
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-protobuf") {
+		require.NoError(t, protobuf.Unmarshal(data, &response))
+	} else {
+		require.NoError(t, protojson.Unmarshal(data, &response), string(data))
+	}
+	return resp.StatusCode, &response
+}
+
+func TestEventsAPIJSON(t *testing.T) {
+	calc, server := startAPIServer(t)
+	base := time.Now()
+
+	single := `{"targetId": "web", "key": "login", "serverTimestamp": "` +
+		unixNano(base) + `"}`
+	status, response := postEvents(t, server.URL, "application/json", []byte(single))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int32(1), response.Accepted)
+	assert.Empty(t, response.Errors)
+
+	batch := `{"events": [
+		{"targetId": "web", "key": "login", "serverTimestamp": "` + unixNano(base.Add(100*time.Millisecond)) + `"},
+		{"targetId": "web", "serverTimestamp": "` + unixNano(base) + `"},
+		{"targetId": "web", "key": "login", "serverTimestamp": "` + unixNano(base.Add(200*time.Millisecond)) + `", "sampleRate": 2}
+	]}`
+	status, response = postEvents(t, server.URL, "application/json; charset=utf-8", []byte(batch))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int32(1), response.Accepted)
+	require.Len(t, response.Errors, 2)
+	assert.Equal(t, int32(1), response.Errors[0].Index)
+	assert.Contains(t, response.Errors[0].Message, "missing key")
+	assert.Equal(t, int32(2), response.Errors[1].Index)
+
+	time.Sleep(100 * time.Millisecond)
+	updates := calc.GetAllMetrics()
+	require.Len(t, updates, 1)
+	assert.Equal(t, int64(2), updates[0].Count)
+}
+
+func TestEventsAPIProtobuf(t *testing.T) {
+	calc, server := startAPIServer(t)
+	base := time.Now()
+
+	batch, err := protobuf.Marshal(&proto.EventBatch{Events: []*proto.Event{
+		{TargetId: "web", Key: "login", ServerTimestamp: base.UnixNano()},
+		{TargetId: "web", Key: "login", ServerTimestamp: base.Add(50 * time.Millisecond).UnixNano()},
+	}})
+	require.NoError(t, err)
+	status, response := postEvents(t, server.URL, "application/x-protobuf", batch)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int32(2), response.Accepted)
+
+	single, err := protobuf.Marshal(&proto.Event{TargetId: "web", Key: "login", ServerTimestamp: base.Add(150 * time.Millisecond).UnixNano()})
+	require.NoError(t, err)
+	status, response = postEvents(t, server.URL, "application/protobuf; messageType=Event", single)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int32(1), response.Accepted)
+
+	time.Sleep(100 * time.Millisecond)
+	updates := calc.GetAllMetrics()
+	require.Len(t, updates, 1)
+	assert.Equal(t, int64(3), updates[0].Count)
+	assert.Equal(t, 100.0, updates[0].Max)
+}
+
+func TestEventsAPIErrors(t *testing.T) {
+	calc, server := startAPIServer(t)
+
+	status, response := postEvents(t, server.URL, "application/json", []byte(`{"events": [{"key": "login"}]}`))
+	assert.Equal(t, http.StatusBadRequest, status, "Every event is invalid")
+	assert.Equal(t, int32(0), response.Accepted)
+	assert.Len(t, response.Errors, 1)
+
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"malformed_json", "application/json", `{"events": `, http.StatusBadRequest},
+		{"unknown_field", "application/json", `{"target": "web"}`, http.StatusBadRequest},
+		{"malformed_protobuf", "application/x-protobuf", "\xff\xff", http.StatusBadRequest},
+		{"unknown_message_type", "application/x-protobuf; messageType=Other", "", http.StatusBadRequest},
+		{"unsupported_type", "text/plain", "hello", http.StatusUnsupportedMediaType},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(server.URL+"/api/events", tt.contentType, strings.NewReader(tt.body))
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+		})
+	}
+
+	// A calculator that turns events away makes the request retryable
+	calc.Close()
+	body := `{"targetId": "web", "key": "login", "serverTimestamp": "1"}`
+	status, response = postEvents(t, server.URL, "application/json", []byte(body))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, "calculator is stopping", response.Errors[0].Message)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/calculator"
+	"github.com/elodin/latency-dash/backend/proto"
+)
+
+const (
+	// maxStreamErrors bounds the errors reported in one response of a stream
+	maxStreamErrors = 1000
+
+	// sendRetryInterval is how often Send retries an event while the
+	// calculator queue is full, and sendQueueTimeout how long it keeps trying
+	sendRetryInterval = 10 * time.Millisecond
+	sendQueueTimeout  = 5 * time.Second
+)
+
+// IngestServer implements the Ingest gRPC service on top of the calculator
+type IngestServer struct {
+	proto.UnimplementedIngestServer
+	calculator *calculator.MetricsCalculator
+}
+
+func NewIngestServer(calculator *calculator.MetricsCalculator) *IngestServer {
+	return &IngestServer{calculator: calculator}
+}
+
+// Send queues the events of a client stream. While the calculator queue is
+// full the next event isn't read, so gRPC flow control pushes back on the
+// client. The response lists up to maxStreamErrors rejected events by their
+// position in the stream.
+func (s *IngestServer) Send(stream proto.Ingest_SendServer) error {
+	response := &proto.IngestResponse{}
+	for index := int32(0); ; index++ {
+		event, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(response)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = calculator.ValidateEvent(event)
+		if err == nil {
+			err = s.enqueue(stream.Context(), event)
+		}
+		if err != nil {
+			if len(response.Errors) < maxStreamErrors {
+				response.Errors = append(response.Errors, &proto.IngestError{Index: index, Message: err.Error()})
+			}
+			continue
+		}
+		response.Accepted++
+	}
+}
+
+// enqueue waits for room in the calculator queue, up to sendQueueTimeout
+func (s *IngestServer) enqueue(ctx context.Context, event *proto.Event) error {
+	ctx, cancel := context.WithTimeout(ctx, sendQueueTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(sendRetryInterval)
+	defer ticker.Stop()
+	for {
+		err := s.calculator.ProcessEvent(event)
+		if !errors.Is(err, calculator.ErrQueueFull) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stream queues every batch it receives and answers with an IngestAck
+// carrying the batch sequence. Acks ask the client to wait before the next
+// batch once the queue passes ingestHighWatermark or events were turned away.
+func (s *IngestServer) Stream(stream proto.Ingest_StreamServer) error {
+	for {
+		batch, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		response, rejected := ingestEvents(s.calculator, batch.Events)
+		ack := newIngestAck(s.calculator, batch.Sequence, response, rejected)
+		if err := stream.Send(ack); err != nil {
+			return err
+		}
+	}
+}
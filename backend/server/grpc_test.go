@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/calculator"
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialIngest serves the Ingest service for calc in memory and returns a client
+func dialIngest(t *testing.T, calc *calculator.MetricsCalculator) proto.IngestClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	proto.RegisterIngestServer(grpcServer, NewIngestServer(calc))
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return proto.NewIngestClient(conn)
+}
+
+func TestIngestSend(t *testing.T) {
+	calc, _ := startAPIServer(t)
+	client := dialIngest(t, calc)
+	base := time.Now()
+
+	stream, err := client.Send(t.Context())
+	require.NoError(t, err)
+	events := []*proto.Event{
+		{TargetId: "web", Key: "login", ServerTimestamp: base.UnixNano()},
+		{TargetId: "web", ServerTimestamp: base.UnixNano()},
+		{TargetId: "web", Key: "login", ServerTimestamp: base.Add(100 * time.Millisecond).UnixNano()},
+	}
+	for _, event := range events {
+		require.NoError(t, stream.Send(event))
+	}
+	response, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), response.Accepted)
+	require.Len(t, response.Errors, 1)
+	assert.Equal(t, int32(1), response.Errors[0].Index)
+	assert.Contains(t, response.Errors[0].Message, "missing key")
+
+	time.Sleep(100 * time.Millisecond)
+	updates := calc.GetAllMetrics()
+	require.Len(t, updates, 1)
+	assert.Equal(t, int64(2), updates[0].Count)
+}
+
+func TestIngestStream(t *testing.T) {
+	calc, _ := startAPIServer(t)
+	client := dialIngest(t, calc)
+	base := time.Now()
+
+	stream, err := client.Stream(t.Context())
+	require.NoError(t, err)
+	for seq := uint64(1); seq <= 3; seq++ {
+		ts := base.Add(time.Duration(seq) * 100 * time.Millisecond)
+		require.NoError(t, stream.Send(&proto.EventBatch{
+			Sequence: seq,
+			Events: []*proto.Event{
+				{TargetId: "web", Key: "login", ServerTimestamp: ts.UnixNano()},
+				{TargetId: "web", Key: "login", ServerTimestamp: ts.UnixNano(), SampleRate: 2},
+			},
+		}))
+		ack, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, seq, ack.Sequence)
+		assert.Equal(t, int32(1), ack.Accepted)
+		require.Len(t, ack.Errors, 1)
+		assert.Equal(t, int32(1), ack.Errors[0].Index)
+		assert.Zero(t, ack.RetryAfterMs)
+	}
+	require.NoError(t, stream.CloseSend())
+}
+
+func TestIngestStreamBackpressure(t *testing.T) {
+	// A calculator that isn't started keeps events queued
+	calc := calculator.NewMetricsCalculator()
+	client := dialIngest(t, calc)
+	base := time.Now()
+
+	stream, err := client.Stream(t.Context())
+	require.NoError(t, err)
+	batch := &proto.EventBatch{Sequence: 1}
+	for i := range 900 {
+		batch.Events = append(batch.Events, &proto.Event{
+			TargetId:        "web",
+			Key:             "login",
+			ServerTimestamp: base.Add(time.Duration(i) * time.Millisecond).UnixNano(),
+		})
+	}
+	require.NoError(t, stream.Send(batch))
+	ack, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, int32(900), ack.Accepted)
+	assert.InDelta(t, 0.9, ack.QueueUsage, 0.001)
+	assert.Positive(t, ack.RetryAfterMs)
+
+	// Events past the queue capacity are rejected
+	batch.Sequence = 2
+	require.NoError(t, stream.Send(batch))
+	ack, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, int32(100), ack.Accepted)
+	assert.Len(t, ack.Errors, 800)
+	assert.Contains(t, ack.Errors[0].Message, calculator.ErrQueueFull.Error())
+	assert.Equal(t, 1.0, ack.QueueUsage)
+	assert.Positive(t, ack.RetryAfterMs)
+}
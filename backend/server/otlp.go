@@ -0,0 +1,209 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/elodin/latency-dash/backend/calculator"
+	"github.com/elodin/latency-dash/backend/proto"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const (
+	// otlpServiceName is the resource attribute naming the target of a span
+	otlpServiceName = "service.name"
+	// otlpUnknownService is the target of spans without a service name, as
+	// the OpenTelemetry SDKs name such services
+	otlpUnknownService = "unknown_service"
+
+	// otlpRetryAfter is the Retry-After header sent when the calculator turns
+	// spans away
+	otlpRetryAfter = "1"
+)
+
+// OTLPConfig selects the attributes kept as metadata by an OTLPReceiver
+type OTLPConfig struct {
+	// ResourceAttributes are resource attributes copied to the metadata of
+	// every span of the resource, e.g. "deployment.environment"
+	ResourceAttributes []string
+	// SpanAttributes are span attributes copied to the metadata, e.g.
+	// "http.response.status_code". They take precedence over resource
+	// attributes of the same name.
+	SpanAttributes []string
+}
+
+// OTLPReceiver turns the spans of OTLP/HTTP trace exports into latency
+// samples. The service name of a span's resource is the target, the span
+// name the key and the span duration the latency, timestamped at the end of
+// the span. Trace and span IDs become the event ID, so spans resent by an
+// exporter after a 503 are dropped when the calculator deduplicates events.
+type OTLPReceiver struct {
+	calculator *calculator.MetricsCalculator
+	config     OTLPConfig
+}
+
+func NewOTLPReceiver(calculator *calculator.MetricsCalculator, config OTLPConfig) *OTLPReceiver {
+	return &OTLPReceiver{calculator: calculator, config: config}
+}
+
+// HandleTraces serves POST /v1/traces, the OTLP/HTTP trace endpoint. The body
+// is a binary protobuf ExportTraceServiceRequest, optionally gzip-compressed.
+// Spans that can't be turned into events are reported as a partial success;
+// if the calculator turns spans away the response is 503 Service
+// Unavailable, asking the exporter to retry.
+func (o *OTLPReceiver) HandleTraces(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != contentTypeProtobuf && mediaType != contentTypeProtobufStandard) {
+		http.Error(w, "OTLP/HTTP traces must be sent as "+contentTypeProtobuf, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxEventsBody)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, "invalid gzip body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		// Bound the decompressed size too
+		body = io.LimitReader(gz, maxEventsBody+1)
+	default:
+		http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	data, err := io.ReadAll(body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || len(data) > maxEventsBody {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "reading body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request collectortrace.ExportTraceServiceRequest
+	if err := protobuf.Unmarshal(data, &request); err != nil {
+		http.Error(w, "invalid export request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var invalid, rejected int64
+	var firstErr error
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				event, err := o.spanEvent(resourceSpans.GetResource().GetAttributes(), span)
+				if err == nil {
+					err = calculator.ValidateEvent(event)
+				}
+				if err != nil {
+					invalid++
+					if firstErr == nil {
+						firstErr = err
+					}
+					continue
+				}
+				if err := o.calculator.ProcessEvent(event); err != nil {
+					rejected++
+					if firstErr == nil {
+						firstErr = err
+					}
+				}
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if rejected > 0 {
+		status = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", otlpRetryAfter)
+	}
+	response := &collectortrace.ExportTraceServiceResponse{}
+	if firstErr != nil {
+		response.PartialSuccess = &collectortrace.ExportTracePartialSuccess{
+			RejectedSpans: invalid + rejected,
+			ErrorMessage:  firstErr.Error(),
+		}
+	}
+	writeProtobuf(w, status, response)
+}
+
+// spanEvent maps a span to an event
+func (o *OTLPReceiver) spanEvent(resource []*commonpb.KeyValue, span *tracepb.Span) (*proto.Event, error) {
+	if span.StartTimeUnixNano == 0 || span.EndTimeUnixNano < span.StartTimeUnixNano {
+		return nil, fmt.Errorf("%w: span %q has invalid start and end times", calculator.ErrInvalidEvent, span.Name)
+	}
+
+	targetID := otlpUnknownService
+	metadata := make(map[string]string)
+	for _, attr := range resource {
+		if attr.Key == otlpServiceName {
+			if value := attributeString(attr.Value); value != "" {
+				targetID = value
+			}
+		}
+	}
+	copyAttributes(metadata, resource, o.config.ResourceAttributes)
+	copyAttributes(metadata, span.Attributes, o.config.SpanAttributes)
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+
+	durationNs := int64(span.EndTimeUnixNano - span.StartTimeUnixNano)
+	event := &proto.Event{
+		TargetId:        targetID,
+		Key:             span.Name,
+		ServerTimestamp: int64(span.EndTimeUnixNano),
+		Metadata:        metadata,
+		TraceId:         hex.EncodeToString(span.TraceId),
+		DurationNs:      &durationNs,
+	}
+	if len(span.TraceId) > 0 && len(span.SpanId) > 0 {
+		event.EventId = event.TraceId + "-" + hex.EncodeToString(span.SpanId)
+	}
+	return event, nil
+}
+
+// copyAttributes copies the selected attributes with a scalar value
+func copyAttributes(metadata map[string]string, attrs []*commonpb.KeyValue, selected []string) {
+	for _, name := range selected {
+		for _, attr := range attrs {
+			if attr.Key != name {
+				continue
+			}
+			if value := attributeString(attr.Value); value != "" {
+				metadata[name] = value
+			}
+		}
+	}
+}
+
+// attributeString formats a scalar attribute value; other values are empty
+func attributeString(value *commonpb.AnyValue) string {
+	switch v := value.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/calculator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func intAttribute(key string, value int64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}}}
+}
+
+// testSpan ends at end and lasts duration
+func testSpan(name string, spanID byte, end time.Time, duration time.Duration, attrs ...*commonpb.KeyValue) *tracepb.Span {
+	return &tracepb.Span{
+		TraceId:           bytes.Repeat([]byte{0xab}, 16),
+		SpanId:            []byte{0, 0, 0, 0, 0, 0, 0, spanID},
+		Name:              name,
+		StartTimeUnixNano: uint64(end.Add(-duration).UnixNano()),
+		EndTimeUnixNano:   uint64(end.UnixNano()),
+		Attributes:        attrs,
+	}
+}
+
+// exportTraces posts an export request the way an OTLP/HTTP exporter does
+func exportTraces(t *testing.T, url string, request *collectortrace.ExportTraceServiceRequest, compress bool) (*http.Response, *collectortrace.ExportTraceServiceResponse) {
+	t.Helper()
+	data, err := protobuf.Marshal(request)
+	require.NoError(t, err)
+
+	httpRequest, err := http.NewRequest(http.MethodPost, url+"/v1/traces", bytes.NewReader(data))
+	require.NoError(t, err)
+	httpRequest.Header.Set("Content-Type", "application/x-protobuf")
+	if compress {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+		httpRequest.Body = io.NopCloser(&buf)
+		httpRequest.ContentLength = int64(buf.Len())
+		httpRequest.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := http.DefaultClient.Do(httpRequest)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	var response collectortrace.ExportTraceServiceResponse
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusServiceUnavailable {
+		require.NoError(t, protobuf.Unmarshal(body, &response))
+	}
+	return resp, &response
+}
+
+func startOTLPServer(t *testing.T, calc *calculator.MetricsCalculator) *httptest.Server {
+	t.Helper()
+	receiver := NewOTLPReceiver(calc, OTLPConfig{
+		ResourceAttributes: []string{"deployment.environment"},
+		SpanAttributes:     []string{"http.response.status_code"},
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/traces", receiver.HandleTraces)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOTLPTraces(t *testing.T) {
+	calc := calculator.NewMetricsCalculatorWithConfig(calculator.Config{DedupWindow: time.Minute})
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go calc.Start(ctx)
+	defer calc.Stop()
+	server := startOTLPServer(t, calc)
+	base := time.Now()
+
+	request := &collectortrace.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{
+			{
+				Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+					stringAttribute("service.name", "checkout"),
+					stringAttribute("deployment.environment", "prod"),
+					stringAttribute("host.name", "ignored"),
+				}},
+				ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{
+					testSpan("GET /cart", 1, base, 30*time.Millisecond, intAttribute("http.response.status_code", 200)),
+					testSpan("GET /cart", 2, base.Add(time.Second), 10*time.Millisecond, intAttribute("http.response.status_code", 200)),
+					{Name: "broken", TraceId: []byte{1}, SpanId: []byte{3}},
+				}}},
+			},
+			{
+				// No service name
+				ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{
+					testSpan("work", 4, base, 5*time.Millisecond),
+				}}},
+			},
+		},
+	}
+	resp, response := exportTraces(t, server.URL, request, false)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotNil(t, response.PartialSuccess)
+	assert.Equal(t, int64(1), response.PartialSuccess.RejectedSpans)
+	assert.Contains(t, response.PartialSuccess.ErrorMessage, "broken")
+
+	// A resent export is dropped by deduplication, compressed or not
+	resp, response = exportTraces(t, server.URL, request, true)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(1), response.PartialSuccess.GetRejectedSpans())
+
+	time.Sleep(100 * time.Millisecond)
+	updates := calc.GetAllMetrics()
+	require.Len(t, updates, 2)
+	byTarget := make(map[string]int)
+	for i, update := range updates {
+		byTarget[update.TargetId] = i
+	}
+
+	checkout := updates[byTarget["checkout"]]
+	assert.Equal(t, "GET /cart", checkout.Key)
+	assert.Equal(t, int64(2), checkout.Count)
+	assert.Equal(t, map[string]string{"deployment.environment": "prod", "http.response.status_code": "200"}, checkout.Metadata)
+	assert.InDelta(t, 10, checkout.Min, 0.001)
+	assert.InDelta(t, 30, checkout.Max, 0.001)
+
+	unknown := updates[byTarget["unknown_service"]]
+	assert.Equal(t, "work", unknown.Key)
+	assert.InDelta(t, 5, unknown.Max, 0.001)
+}
+
+func TestOTLPTracesRejected(t *testing.T) {
+	calc := calculator.NewMetricsCalculator()
+	server := startOTLPServer(t, calc)
+
+	// A closed calculator turns every span away
+	calc.Close()
+
+	request := &collectortrace.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+		ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{testSpan("work", 1, time.Now(), time.Millisecond)}}},
+	}}}
+	resp, response := exportTraces(t, server.URL, request, false)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	assert.Equal(t, int64(1), response.PartialSuccess.GetRejectedSpans())
+
+	jsonResp, err := http.Post(server.URL+"/v1/traces", "application/json", bytes.NewReader([]byte("{}")))
+	require.NoError(t, err)
+	jsonResp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, jsonResp.StatusCode)
+}
+
+func TestOTLPTracesClockSteps(t *testing.T) {
+	calc := calculator.NewMetricsCalculatorWithConfig(calculator.Config{ClockStepThreshold: time.Second})
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go calc.Start(ctx)
+	defer calc.Stop()
+	server := startOTLPServer(t, calc)
+
+	// A batch span processor exports the spans that ended during the last
+	// 5s, so a span reaches us anywhere from 0 to 5s after its end time. A
+	// quiet service exports a single span per batch.
+	delays := []time.Duration{100, 4500, 2500, 300, 4900, 1200}
+	for i := range 12 {
+		now := time.Now()
+		spans := []*tracepb.Span{testSpan("GET /cart", byte(2*i), now.Add(-delays[i%len(delays)]*time.Millisecond), 10*time.Millisecond)}
+		if i >= 6 {
+			// Busier batches hold spans of the whole period
+			spans = append(spans, testSpan("GET /cart", byte(2*i+1), now.Add(-50*time.Millisecond), 10*time.Millisecond))
+		}
+		request := &collectortrace.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource:   &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttribute("service.name", "checkout")}},
+			ScopeSpans: []*tracepb.ScopeSpans{{Spans: spans}},
+		}}}
+		resp, _ := exportTraces(t, server.URL, request, false)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		time.Sleep(60 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	stats := calc.TargetStats()
+	require.Len(t, stats, 1)
+	assert.Equal(t, "checkout", stats[0].TargetId)
+	assert.Zero(t, stats[0].ClockSteps)
+}
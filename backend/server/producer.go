@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/calculator"
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// producerAckInterval is how often producers are told how their events fared
+	producerAckInterval = 1 * time.Second
+)
+
+// producerStream collects the outcome of a producer's messages between acks
+type producerStream struct {
+	mu       sync.Mutex
+	received uint64 // Messages received on the connection
+	response *proto.IngestResponse
+	rejected bool // The calculator turned events away since the last ack
+}
+
+// record counts a message; err is why it was rejected, if it was
+func (p *producerStream) record(err error, rejected bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	index := p.received
+	p.received++
+	if p.response == nil {
+		p.response = &proto.IngestResponse{}
+	}
+	if err != nil {
+		if len(p.response.Errors) < maxStreamErrors {
+			p.response.Errors = append(p.response.Errors, &proto.IngestError{Index: int32(index), Message: err.Error()})
+		}
+		p.rejected = p.rejected || rejected
+		return
+	}
+	p.response.Accepted++
+}
+
+// ack acknowledges the messages received since the last ack, or returns nil
+// if there are none. The sequence is the number of messages received so far.
+func (p *producerStream) ack(calc *calculator.MetricsCalculator) *proto.IngestAck {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.response == nil {
+		return nil
+	}
+	ack := newIngestAck(calc, p.received, p.response, p.rejected)
+	p.response = nil
+	p.rejected = false
+	return ack
+}
+
+// handleProducer queues the events a producer sends until it disconnects.
+// Every producerAckInterval the producer gets an IngestAck for the messages
+// it sent since the previous one, listing rejected messages by their position
+// on the connection.
+func (s *WebSocketServer) handleProducer(conn *websocket.Conn) {
+	defer conn.Close()
+	log.Printf("New producer connected")
+
+	stream := &producerStream{}
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(producerAckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if ack := stream.ack(s.calculator); ack != nil {
+					s.sendMessage(conn, &proto.WebSocketMessage{
+						Content: &proto.WebSocketMessage_IngestAck{
+							IngestAck: ack,
+						},
+					})
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("Error reading producer message: %v", err)
+			}
+			return
+		}
+
+		var wsMsg proto.WebSocketMessage
+		if err := protojson.Unmarshal(message, &wsMsg); err != nil {
+			stream.record(fmt.Errorf("invalid message: %w", err), false)
+			continue
+		}
+		event := wsMsg.GetEvent()
+		if event == nil {
+			stream.record(fmt.Errorf("producers only send events, got %T", wsMsg.Content), false)
+			continue
+		}
+
+		err = calculator.ValidateEvent(event)
+		rejected := false
+		if err == nil {
+			if err = s.calculator.ProcessEvent(event); err != nil {
+				rejected = true
+			}
+		}
+		stream.record(err, rejected)
+	}
+}
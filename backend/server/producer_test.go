@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elodin/latency-dash/backend/calculator"
+	"github.com/elodin/latency-dash/backend/proto"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestWebSocketProducer(t *testing.T) {
+	calc := calculator.NewMetricsCalculator()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go calc.Start(ctx)
+	defer calc.Stop()
+
+	wsServer := NewWebSocketServer(calc)
+	server := httptest.NewServer(http.HandlerFunc(wsServer.HandleWebSocket))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?mode=producer", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	base := time.Now()
+	for _, event := range []*proto.Event{
+		{TargetId: "edge", Key: "render", ServerTimestamp: base.UnixNano()},
+		{TargetId: "edge", ServerTimestamp: base.UnixNano()},
+		{TargetId: "edge", Key: "render", ServerTimestamp: base.Add(100 * time.Millisecond).UnixNano()},
+	} {
+		data, err := protojson.Marshal(&proto.WebSocketMessage{
+			Content: &proto.WebSocketMessage_Event{Event: event},
+		})
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, data))
+	}
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("not json")))
+
+	conn.SetReadDeadline(time.Now().Add(2 * producerAckInterval))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	var msg proto.WebSocketMessage
+	require.NoError(t, protojson.Unmarshal(data, &msg))
+	ack := msg.GetIngestAck()
+	require.NotNil(t, ack, string(data))
+	assert.Equal(t, uint64(4), ack.Sequence)
+	assert.Equal(t, int32(2), ack.Accepted)
+	require.Len(t, ack.Errors, 2)
+	assert.Equal(t, int32(1), ack.Errors[0].Index)
+	assert.Contains(t, ack.Errors[0].Message, "missing key")
+	assert.Equal(t, int32(3), ack.Errors[1].Index)
+	assert.Contains(t, ack.Errors[1].Message, "invalid message")
+	assert.Zero(t, ack.RetryAfterMs)
+
+	updates := calc.GetAllMetrics()
+	require.Len(t, updates, 1)
+	assert.Equal(t, "edge", updates[0].TargetId)
+	assert.Equal(t, int64(2), updates[0].Count)
+
+	// Producers aren't sent metrics broadcasts
+	wsServer.clientsMu.Lock()
+	assert.Empty(t, wsServer.clients)
+	wsServer.clientsMu.Unlock()
+}
+
+func TestWebSocketUnknownMode(t *testing.T) {
+	calc := calculator.NewMetricsCalculator()
+	server := httptest.NewServer(http.HandlerFunc(NewWebSocketServer(calc).HandleWebSocket))
+	defer server.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?mode=spectator", nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
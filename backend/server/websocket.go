@@ -28,12 +28,34 @@ type WebSocketServer struct {
 	calculator *calculator.MetricsCalculator
 	clients    map[*websocket.Conn]bool
 	clientsMu  sync.Mutex
+
+	topK     map[*websocket.Conn]*topKStream    // Top-K subscriptions, guarded by clientsMu
+	heatmaps map[*websocket.Conn]*heatmapFilter // Heatmap subscriptions, guarded by clientsMu
+}
+
+// topKStream forwards a Top-K view to one client
+type topKStream struct {
+	ch        chan *proto.TopKUpdate
+	exclusive bool            // Only forward MetricsUpdates of members
+	members   map[string]bool // Series IDs in the view, guarded by clientsMu
+}
+
+// heatmapFilter selects the heatmap columns a client subscribed to
+type heatmapFilter struct {
+	seriesIDs map[string]bool
+	targetID  string
+}
+
+func (f *heatmapFilter) matches(frame *proto.HeatmapFrame) bool {
+	return f.seriesIDs[frame.SeriesId] || (f.targetID != "" && f.targetID == frame.TargetId)
 }
 
 func NewWebSocketServer(calculator *calculator.MetricsCalculator) *WebSocketServer {
 	server := &WebSocketServer{
 		calculator: calculator,
 		clients:    make(map[*websocket.Conn]bool),
+		topK:       make(map[*websocket.Conn]*topKStream),
+		heatmaps:   make(map[*websocket.Conn]*heatmapFilter),
 	}
 
 	// Start a goroutine to listen for metrics updates
@@ -44,10 +66,26 @@ func NewWebSocketServer(calculator *calculator.MetricsCalculator) *WebSocketServ
 		}
 	}()
 
+	// And another for heatmap columns as they close
+	go func() {
+		subscriber := calculator.SubscribeHeatmaps()
+		for frame := range subscriber {
+			server.BroadcastHeatmapFrame(frame)
+		}
+	}()
+
 	return server
 }
 
+// HandleWebSocket serves /ws. Clients subscribe to metrics by default; with
+// ?mode=producer they send Events instead and receive periodic IngestAcks.
 func (s *WebSocketServer) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode != "" && mode != "producer" {
+		http.Error(w, "unknown mode: "+mode, http.StatusBadRequest)
+		return
+	}
+
 	// Upgrade the HTTP connection to a WebSocket connection
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -55,6 +93,12 @@ func (s *WebSocketServer) HandleWebSocket(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// Producers don't receive broadcasts, so they aren't registered as clients
+	if mode == "producer" {
+		s.handleProducer(conn)
+		return
+	}
+
 	// Register client
 	func() {
 		s.clientsMu.Lock()
@@ -66,6 +110,8 @@ func (s *WebSocketServer) HandleWebSocket(w http.ResponseWriter, r *http.Request
 	// Set up a context to handle client disconnection
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	defer s.cancelTopK(conn)
+	defer s.cancelHeatmaps(conn)
 
 	// Start a goroutine to handle ping/pong
 	go func() {
@@ -108,6 +154,16 @@ func (s *WebSocketServer) HandleWebSocket(w http.ResponseWriter, r *http.Request
 		switch msg := wsMsg.Content.(type) {
 		case *proto.WebSocketMessage_Subscription:
 			s.handleSubscription(conn, msg.Subscription)
+		case *proto.WebSocketMessage_TopKSubscription:
+			s.handleTopKSubscription(conn, msg.TopKSubscription)
+		case *proto.WebSocketMessage_HeatmapSubscription:
+			s.handleHeatmapSubscription(conn, msg.HeatmapSubscription)
+		case *proto.WebSocketMessage_DiscoveryRequest:
+			s.sendMessage(conn, &proto.WebSocketMessage{
+				Content: &proto.WebSocketMessage_DiscoveryIndex{
+					DiscoveryIndex: s.calculator.Discovery(msg.DiscoveryRequest.TargetId),
+				},
+			})
 		default:
 			log.Printf("Received unhandled message type: %T", msg)
 		}
@@ -178,20 +234,149 @@ func (s *WebSocketServer) handleSubscription(conn *websocket.Conn, msg *proto.Su
 	}
 }
 
-func (s *WebSocketServer) Broadcast(update *proto.MetricsUpdate) {
+// handleTopKSubscription replaces the client's Top-K view and streams the
+// view's rankings to it until it changes again or disconnects
+func (s *WebSocketServer) handleTopKSubscription(conn *websocket.Conn, msg *proto.TopKSubscription) {
+	s.cancelTopK(conn)
+	if msg.K == 0 {
+		return
+	}
+
+	ch, err := s.calculator.SubscribeTopK(msg.Statistic, int(msg.K))
+	if err != nil {
+		s.sendMessage(conn, &proto.WebSocketMessage{
+			Content: &proto.WebSocketMessage_SubscriptionAck{
+				SubscriptionAck: &proto.SubscriptionAck{
+					Success: false,
+					Message: err.Error(),
+				},
+			},
+		})
+		return
+	}
+
+	stream := &topKStream{ch: ch, exclusive: msg.Exclusive}
 	s.clientsMu.Lock()
-	defer s.clientsMu.Unlock()
+	s.topK[conn] = stream
+	s.clientsMu.Unlock()
 
-	if len(s.clients) == 0 {
-		log.Println("No clients connected to broadcast to")
+	go func() {
+		for update := range ch {
+			members := make(map[string]bool, len(update.Entries))
+			for _, entry := range update.Entries {
+				members[entry.SeriesId] = true
+			}
+			s.clientsMu.Lock()
+			stream.members = members
+			s.clientsMu.Unlock()
+
+			s.sendMessage(conn, &proto.WebSocketMessage{
+				Content: &proto.WebSocketMessage_TopKUpdate{
+					TopKUpdate: update,
+				},
+			})
+		}
+	}()
+}
+
+// handleHeatmapSubscription replaces the heatmap columns the client receives
+func (s *WebSocketServer) handleHeatmapSubscription(conn *websocket.Conn, msg *proto.HeatmapSubscription) {
+	if len(msg.SeriesIds) == 0 && msg.TargetId == "" {
+		s.cancelHeatmaps(conn)
+		return
+	}
+
+	filter := &heatmapFilter{seriesIDs: make(map[string]bool, len(msg.SeriesIds)), targetID: msg.TargetId}
+	for _, id := range msg.SeriesIds {
+		filter.seriesIDs[id] = true
+	}
+	s.clientsMu.Lock()
+	s.heatmaps[conn] = filter
+	s.clientsMu.Unlock()
+}
+
+// cancelHeatmaps ends the client's heatmap subscription, if any
+func (s *WebSocketServer) cancelHeatmaps(conn *websocket.Conn) {
+	s.clientsMu.Lock()
+	delete(s.heatmaps, conn)
+	s.clientsMu.Unlock()
+}
+
+// cancelTopK ends the client's Top-K subscription, if any
+func (s *WebSocketServer) cancelTopK(conn *websocket.Conn) {
+	s.clientsMu.Lock()
+	stream, exists := s.topK[conn]
+	delete(s.topK, conn)
+	s.clientsMu.Unlock()
+	if exists {
+		s.calculator.UnsubscribeTopK(stream.ch)
+	}
+}
+
+// sendMessage writes a message to a single client. Writes are serialized
+// with broadcasts by clientsMu.
+func (s *WebSocketServer) sendMessage(conn *websocket.Conn, wsMsg *proto.WebSocketMessage) {
+	marshaler := protojson.MarshalOptions{
+		UseProtoNames: false, // Use camelCase instead of snake_case
+	}
+	data, err := marshaler.Marshal(wsMsg)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return
+	}
+
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	if err := conn.SetWriteDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		log.Printf("Error setting write deadline: %v", err)
 		return
 	}
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		log.Printf("Error sending message to client: %v", err)
+	}
+}
 
+func (s *WebSocketServer) Broadcast(update *proto.MetricsUpdate) {
 	// Wrap the MetricsUpdate in a WebSocketMessage envelope
-	wsMsg := &proto.WebSocketMessage{
+	s.broadcastMessageTo(&proto.WebSocketMessage{
 		Content: &proto.WebSocketMessage_MetricsUpdate{
 			MetricsUpdate: update,
 		},
+	}, func(client *websocket.Conn) bool {
+		return s.inTopK(client, update.SeriesId)
+	})
+}
+
+// inTopK reports whether a client gets the messages of a series; clients
+// following a Top-K view exclusively only get its members. Called with
+// clientsMu held.
+func (s *WebSocketServer) inTopK(client *websocket.Conn, seriesID string) bool {
+	stream, exists := s.topK[client]
+	return !exists || !stream.exclusive || stream.members[seriesID]
+}
+
+// BroadcastHeatmapFrame sends a closed heatmap column to the clients that
+// subscribed to its series
+func (s *WebSocketServer) BroadcastHeatmapFrame(frame *proto.HeatmapFrame) {
+	s.broadcastMessageTo(&proto.WebSocketMessage{
+		Content: &proto.WebSocketMessage_HeatmapFrame{
+			HeatmapFrame: frame,
+		},
+	}, func(client *websocket.Conn) bool {
+		filter, subscribed := s.heatmaps[client]
+		return subscribed && filter.matches(frame) && s.inTopK(client, frame.SeriesId)
+	})
+}
+
+// broadcastMessageTo sends a message to the clients accepted by include,
+// or to all clients if include is nil. include is called with clientsMu held.
+func (s *WebSocketServer) broadcastMessageTo(wsMsg *proto.WebSocketMessage, include func(*websocket.Conn) bool) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if len(s.clients) == 0 {
+		log.Println("No clients connected to broadcast to")
+		return
 	}
 
 	// Marshal to JSON with camelCase field names
@@ -208,6 +393,10 @@ func (s *WebSocketServer) Broadcast(update *proto.MetricsUpdate) {
 	// Uncomment to debug: log.Printf("Broadcasting metrics update: %s", string(data))
 
 	for client := range s.clients {
+		if include != nil && !include(client) {
+			continue
+		}
+
 		// Set a write deadline to prevent blocking
 		err := client.SetWriteDeadline(time.Now().Add(5 * time.Second))
 		if err != nil {
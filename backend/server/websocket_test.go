@@ -12,6 +12,8 @@ import (
 	"github.com/elodin/latency-dash/backend/proto"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
 // TestWebSocketServer tests the WebSocket server functionality
@@ -233,3 +235,183 @@ func TestWebSocketServerSubscriptionHandling(t *testing.T) {
 	// Close connection
 	conn.Close()
 }
+
+// TestWebSocketTopK tests following a Top-K view exclusively
+func TestWebSocketTopK(t *testing.T) {
+	calc := calculator.NewMetricsCalculator()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go calc.Start(ctx)
+	defer calc.Stop()
+
+	// Two series, "slow" ranking above "fast" by max
+	base := time.Now()
+	for _, e := range []struct {
+		key    string
+		offset time.Duration
+	}{{"fast", 0}, {"fast", 10 * time.Millisecond}, {"slow", 0}, {"slow", 100 * time.Millisecond}} {
+		require.NoError(t, calc.ProcessEvent(&proto.Event{
+			TargetId:        "test-target",
+			Key:             e.key,
+			ServerTimestamp: base.Add(e.offset).UnixNano(),
+		}))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	wsServer := NewWebSocketServer(calc)
+	server := httptest.NewServer(http.HandlerFunc(wsServer.HandleWebSocket))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	data, err := protojson.Marshal(&proto.WebSocketMessage{
+		Content: &proto.WebSocketMessage_TopKSubscription{
+			TopKSubscription: &proto.TopKSubscription{
+				Statistic: proto.TopKStatistic_TOP_K_STATISTIC_MAX,
+				K:         1,
+				Exclusive: true,
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, data))
+
+	read := func() *proto.WebSocketMessage {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		var msg proto.WebSocketMessage
+		require.NoError(t, protojson.Unmarshal(data, &msg))
+		return &msg
+	}
+
+	ranking := read().GetTopKUpdate()
+	require.NotNil(t, ranking)
+	require.Len(t, ranking.Entries, 1)
+	assert.Equal(t, "slow", ranking.Entries[0].Key)
+
+	// Only the member's MetricsUpdates reach the client
+	wsServer.Broadcast(&proto.MetricsUpdate{SeriesId: "test-target:fast", Key: "fast"})
+	wsServer.Broadcast(&proto.MetricsUpdate{SeriesId: ranking.Entries[0].SeriesId, Key: "slow"})
+	update := read().GetMetricsUpdate()
+	require.NotNil(t, update)
+	assert.Equal(t, "slow", update.Key)
+
+	// And so do their heatmap columns
+	data, err = protojson.Marshal(&proto.WebSocketMessage{
+		Content: &proto.WebSocketMessage_HeatmapSubscription{
+			HeatmapSubscription: &proto.HeatmapSubscription{TargetId: "test-target"},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, data))
+	time.Sleep(50 * time.Millisecond)
+	wsServer.BroadcastHeatmapFrame(&proto.HeatmapFrame{SeriesId: "test-target:fast", TargetId: "test-target"})
+	wsServer.BroadcastHeatmapFrame(&proto.HeatmapFrame{SeriesId: ranking.Entries[0].SeriesId, TargetId: "test-target"})
+	frame := read().GetHeatmapFrame()
+	require.NotNil(t, frame)
+	assert.Equal(t, ranking.Entries[0].SeriesId, frame.SeriesId)
+}
+
+// TestWebSocketHeatmapSubscription tests that heatmap columns only reach
+// the clients that asked for them
+func TestWebSocketHeatmapSubscription(t *testing.T) {
+	calc := calculator.NewMetricsCalculator()
+	wsServer := NewWebSocketServer(calc)
+	server := httptest.NewServer(http.HandlerFunc(wsServer.HandleWebSocket))
+	defer server.Close()
+
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+		require.NoError(t, err)
+		return conn
+	}
+	send := func(conn *websocket.Conn, msg *proto.WebSocketMessage) {
+		data, err := protojson.Marshal(msg)
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, data))
+	}
+	subscribe := func(conn *websocket.Conn, sub *proto.HeatmapSubscription) {
+		send(conn, &proto.WebSocketMessage{
+			Content: &proto.WebSocketMessage_HeatmapSubscription{HeatmapSubscription: sub},
+		})
+	}
+
+	bySeries, byTarget, none := dial(), dial(), dial()
+	defer bySeries.Close()
+	defer byTarget.Close()
+	defer none.Close()
+	subscribe(bySeries, &proto.HeatmapSubscription{SeriesIds: []string{"east:b"}})
+	subscribe(byTarget, &proto.HeatmapSubscription{TargetId: "east"})
+	time.Sleep(50 * time.Millisecond)
+
+	for _, id := range []string{"west:a", "east:a", "east:b"} {
+		target, _, _ := strings.Cut(id, ":")
+		wsServer.BroadcastHeatmapFrame(&proto.HeatmapFrame{SeriesId: id, TargetId: target})
+	}
+
+	// readFrames collects the frames a client gets within a short while
+	readFrames := func(conn *websocket.Conn) []string {
+		var ids []string
+		for {
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return ids
+			}
+			var msg proto.WebSocketMessage
+			require.NoError(t, protojson.Unmarshal(data, &msg))
+			if frame := msg.GetHeatmapFrame(); frame != nil {
+				ids = append(ids, frame.SeriesId)
+			}
+		}
+	}
+	assert.Equal(t, []string{"east:b"}, readFrames(bySeries))
+	assert.Equal(t, []string{"east:a", "east:b"}, readFrames(byTarget))
+	assert.Empty(t, readFrames(none))
+}
+
+// TestWebSocketDiscovery tests requesting the discovery index
+func TestWebSocketDiscovery(t *testing.T) {
+	calc := calculator.NewMetricsCalculator()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go calc.Start(ctx)
+	defer calc.Stop()
+
+	require.NoError(t, calc.ProcessEvent(&proto.Event{
+		TargetId:        "test-target",
+		Key:             "test-key",
+		ServerTimestamp: time.Now().UnixNano(),
+	}))
+	time.Sleep(50 * time.Millisecond)
+
+	server := httptest.NewServer(http.HandlerFunc(NewWebSocketServer(calc).HandleWebSocket))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	data, err := protojson.Marshal(&proto.WebSocketMessage{
+		Content: &proto.WebSocketMessage_DiscoveryRequest{
+			DiscoveryRequest: &proto.DiscoveryRequest{},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, data))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err = conn.ReadMessage()
+	require.NoError(t, err)
+	var msg proto.WebSocketMessage
+	require.NoError(t, protojson.Unmarshal(data, &msg))
+	index := msg.GetDiscoveryIndex()
+	require.NotNil(t, index)
+	require.Len(t, index.Targets, 1)
+	assert.Equal(t, "test-target", index.Targets[0].TargetId)
+	require.Len(t, index.Targets[0].Keys, 1)
+	assert.Equal(t, "test-key", index.Targets[0].Keys[0].Key)
+}